@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	adminMonitorCMD       = "monitor"
+	adminRuokCMD          = "ruok"
+	adminServerStatsCMD   = "server_stats"
+	adminEnvironmentCMD   = "environment"
+	adminConfigurationCMD = "configuration"
+)
+
+// returned when an AdminServer command fails because the server isn't serving requests, e.g. while it has no quorum
+var errAdminNotServing = errors.New(notServingRequests)
+
+// isAdminURL tells AdminServer targets (http://host:8080) apart from four letter word ones (host:2181)
+func isAdminURL(target string) bool {
+	return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
+
+// adminCommand runs a command on the ZooKeeper 3.5+ AdminServer, and returns its decoded JSON response
+func (zk *zkServer) adminCommand(ctx context.Context, cmd string) (map[string]interface{}, error) {
+	// same budget as a four letter word: time to connect plus time to read & write
+	timeout := zk.connectTimeout + zk.rwDeadline
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, zk.adminURL+"/commands/"+cmd, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := zk.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.TLS != nil {
+		zk.recordPeerCertificate(*resp.TLS)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("[%v] failed to close response body: %v", zk.ipPort, err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("AdminServer command %v returned %v", cmd, resp.Status)
+	}
+
+	// UseNumber, so large counters and zxids don't get mangled into float64
+	var body map[string]interface{}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode AdminServer %v response: %v", cmd, err)
+	}
+
+	if cmdErr, ok := body["error"]; ok && cmdErr != nil {
+		if msg, ok := cmdErr.(string); ok && strings.HasPrefix(msg, notServingRequests) {
+			return body, errAdminNotServing
+		}
+		return body, fmt.Errorf("AdminServer command %v failed: %v", cmd, cmdErr)
+	}
+	return body, nil
+}
+
+// flattenAdmin converts the scalar values of an AdminServer response to strings, keyed by prefix + key. Nested
+// objects and the command / error bookkeeping fields are skipped
+func flattenAdmin(body map[string]interface{}, prefix string) map[string]string {
+	flat := make(map[string]string)
+	for key, value := range body {
+		if key == "command" || key == "error" {
+			continue
+		}
+		switch v := value.(type) {
+		case json.Number:
+			flat[prefix+key] = v.String()
+		case string:
+			flat[prefix+key] = v
+		case bool:
+			flat[prefix+key] = strconv.FormatBool(v)
+		}
+	}
+	return flat
+}
+
+// getAdminStats is getStats for the AdminServer: monitor reports the same values as mntr, minus the zk_ prefix, and
+// server_stats has the zxid srvr would give us, if the zxid collector is enabled. A server that isn't serving requests
+// is up, without stats, like with four letter words
+func (zk *zkServer) getAdminStats(ctx context.Context) (map[string]string, error) {
+	stats := make(map[string]string)
+	monitor, err := zk.adminCommand(ctx, adminMonitorCMD)
+	switch {
+	case err == errAdminNotServing:
+		log.Warnf("[%v] is up but not currently serving requests", zk.ipPort)
+	case err != nil:
+		return stats, err
+	default:
+		stats = flattenAdmin(monitor, "zk_")
+	}
+
+	if _, err := zk.adminCommand(ctx, adminRuokCMD); err != nil {
+		return stats, err
+	}
+	stats[zkOK] = "imok"
+	if !zk.collectors[collectorZxid] {
+		return stats, nil
+	}
+
+	// server_stats isn't essential, so don't fail the whole poll over it
+	serverStats, err := zk.adminCommand(ctx, adminServerStatsCMD)
+	if err == errAdminNotServing {
+		return stats, nil
+	}
+	if err != nil {
+		log.Warnf("[%v] failed to get zxid: %v", zk.ipPort, err)
+		return stats, nil
+	}
+	if nested, ok := serverStats["server_stats"].(map[string]interface{}); ok {
+		if zxid, ok := nested["last_processed_zxid"].(json.Number); ok {
+			if z, err := strconv.ParseUint(zxid.String(), 10, 64); err == nil {
+				setZxidStats(stats, z)
+			}
+		}
+	}
+	return stats, nil
+}
+
+// getAdminInfo is the AdminServer equivalent of envi and conf
+func (zk *zkServer) getAdminInfo(ctx context.Context) (*zkInfo, error) {
+	environment, err := zk.adminCommand(ctx, adminEnvironmentCMD)
+	if err != nil {
+		return nil, err
+	}
+	configuration, err := zk.adminCommand(ctx, adminConfigurationCMD)
+	if err != nil {
+		return nil, err
+	}
+
+	// configuration uses snake case keys (tick_time), conf uses camel case (tickTime)
+	snakeConf := flattenAdmin(configuration, "")
+	conf := make(map[string]string)
+	for _, l := range configLabels {
+		if v, ok := snakeConf[l.label]; ok {
+			conf[l.key] = v
+		}
+	}
+
+	return &zkInfo{
+		envi:    flattenAdmin(environment, ""),
+		conf:    conf,
+		fetched: time.Now(),
+	}, nil
+}
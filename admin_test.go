@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// a minimal AdminServer serving canned responses
+func newTestAdminServer(t *testing.T, responses map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, ok := responses[req.URL.Path]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(body))
+	}))
+}
+
+func TestAdminBackend(t *testing.T) {
+	defer func(timeout int, deadline float64) { *zkTimeout, *zkRWDeadLine = timeout, deadline }(*zkTimeout, *zkRWDeadLine)
+	*zkTimeout, *zkRWDeadLine = 1, 1
+
+	server := newTestAdminServer(t, map[string]string{
+		"/commands/monitor": `{"version":"3.6.2--803c7f1a12f85978cb049af5e4ef23bd8b688715, built on 09/04/2020 12:44 GMT",
+			"avg_latency":0.5,"server_state":"leader","znode_count":42,"synced_followers":2,
+			"command":"monitor","error":null}`,
+		"/commands/ruok":         `{"command":"ruok","error":null}`,
+		"/commands/server_stats": `{"server_stats":{"last_processed_zxid":12884901890},"command":"server_stats","error":null}`,
+		"/commands/environment":  `{"zookeeper.version":"3.6.2--803c7f1a, built on 09/04/2020 12:44 GMT","java.version":"11.0.9.1","command":"environment","error":null}`,
+		"/commands/configuration": `{"tick_time":2000,"init_limit":5,"sync_limit":2,"data_dir":"/data/version-2",
+			"server_id":1,"command":"configuration","error":null}`,
+	})
+	defer server.Close()
+
+	zk := newZKServer(server.URL + "/")
+	assert.Equal(t, zk.adminURL, server.URL)
+	zk.collectors = collectorSet{collectorZxid: true}
+
+	t.Run("stats use mntr names", func(t *testing.T) {
+		stats, err := zk.getStats(context.Background())
+		assert.NilError(t, err)
+		assert.Equal(t, stats[zkAvgLatency], "0.5")
+		assert.Equal(t, stats[zkServerState], "leader")
+		assert.Equal(t, stats[zkZnodeCount], "42")
+		assert.Equal(t, stats[zkSyncedFollowers], "2")
+		assert.Equal(t, stats[zkOK], "imok")
+		assert.Equal(t, stats[zkZxid], "12884901890")
+		assert.Equal(t, stats[zkEpoch], "3")
+		_, ok := stats["zk_command"]
+		assert.Assert(t, !ok)
+	})
+
+	t.Run("info uses conf names", func(t *testing.T) {
+		info, err := zk.getInfo(context.Background(), 0)
+		assert.NilError(t, err)
+		assert.Equal(t, info.envi["java.version"], "11.0.9.1")
+		assert.Equal(t, info.conf["tickTime"], "2000")
+		assert.Equal(t, info.conf["serverId"], "1")
+	})
+
+	t.Run("not serving requests is up without stats, like with four letter words", func(t *testing.T) {
+		notServing := newTestAdminServer(t, map[string]string{
+			"/commands/monitor":      `{"command":"monitor","error":"This ZooKeeper instance is not currently serving requests"}`,
+			"/commands/ruok":         `{"command":"ruok","error":null}`,
+			"/commands/server_stats": `{"command":"server_stats","error":"This ZooKeeper instance is not currently serving requests"}`,
+		})
+		defer notServing.Close()
+
+		stats, err := newZKServer(notServing.URL).getStats(context.Background())
+		assert.NilError(t, err)
+		assert.DeepEqual(t, stats, map[string]string{zkOK: "imok"})
+	})
+
+	t.Run("other command errors fail the poll", func(t *testing.T) {
+		broken := newTestAdminServer(t, map[string]string{
+			"/commands/monitor": `{"command":"monitor","error":"Unknown command"}`,
+		})
+		defer broken.Close()
+
+		_, err := newZKServer(broken.URL).getStats(context.Background())
+		assert.Assert(t, err != nil)
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+// analysis is what `zookeeper_exporter analyze` reports about a dataDir
+type analysis struct {
+	Snapshot        string         `json:"snapshot,omitempty"`
+	SnapshotZxid    int64          `json:"snapshot_zxid,omitempty"`
+	Sessions        int            `json:"sessions"`
+	Znodes          int            `json:"znodes"`
+	EphemeralZnodes int            `json:"ephemeral_znodes"`
+	DataBytes       int64          `json:"data_bytes"`
+	Paths           []pathUsage    `json:"paths"`
+	Largest         []pathUsage    `json:"largest_znodes"`
+	TxnLogs         int            `json:"txn_logs"`
+	Transactions    int            `json:"transactions"`
+	TxnLogSeconds   float64        `json:"txn_log_seconds"`
+	TxnTypes        []txnTypeUsage `json:"transaction_types"`
+}
+
+// pathUsage sums up the znodes and transactions under a path prefix, or describes a single znode
+type pathUsage struct {
+	Path         string `json:"path"`
+	Znodes       int    `json:"znodes,omitempty"`
+	DataBytes    int64  `json:"data_bytes"`
+	Transactions int    `json:"transactions,omitempty"`
+}
+
+type txnTypeUsage struct {
+	Type      string  `json:"type"`
+	Count     int     `json:"count"`
+	PerSecond float64 `json:"per_second"`
+}
+
+// analyzeDataDir reads the latest snapshot and all txnlogs. Znodes and transactions are summed up by the first
+// pathDepth components of their path, and the topN largest znodes are listed.
+func analyzeDataDir(dataDir, txnLogDir string, pathDepth, topN int) (*analysis, error) {
+	dataDir = versionDir(dataDir)
+	if txnLogDir == "" {
+		txnLogDir = dataDir
+	}
+	txnLogDir = versionDir(txnLogDir)
+
+	a := &analysis{}
+	paths := make(map[string]*pathUsage)
+	usage := func(path string) *pathUsage {
+		prefix := pathPrefix(path, pathDepth)
+		u, ok := paths[prefix]
+		if !ok {
+			u = &pathUsage{Path: prefix}
+			paths[prefix] = u
+		}
+		return u
+	}
+
+	snapshots, err := findDataFiles(dataDir, "snapshot.")
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) > 0 {
+		latest := snapshots[len(snapshots)-1]
+		byts, err := readDataFile(latest.name)
+		if err != nil {
+			return nil, err
+		}
+		snap, err := parseSnapshot(byts)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", latest.name, err)
+		}
+
+		a.Snapshot, a.SnapshotZxid, a.Sessions = filepath.Base(latest.name), latest.zxid, snap.sessions
+		for _, z := range snap.znodes {
+			a.Znodes++
+			a.DataBytes += int64(z.dataLength)
+			if z.ephemeralOwner != 0 {
+				a.EphemeralZnodes++
+			}
+			u := usage(z.path)
+			u.Znodes++
+			u.DataBytes += int64(z.dataLength)
+			a.Largest = append(a.Largest, pathUsage{Path: z.path, DataBytes: int64(z.dataLength)})
+		}
+		sort.SliceStable(a.Largest, func(i, j int) bool { return a.Largest[i].DataBytes > a.Largest[j].DataBytes })
+		if topN > 0 && len(a.Largest) > topN {
+			a.Largest = a.Largest[:topN]
+		}
+	}
+
+	logs, err := findDataFiles(txnLogDir, "log.")
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]int)
+	var firstTime, lastTime int64
+	for _, l := range logs {
+		byts, err := readDataFile(l.name)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := parseTxnLog(byts)
+		if err != nil {
+			// use what we could read, the rest of the log is likely just as broken
+			log.Warnf("%v: %v", l.name, err)
+		}
+		a.TxnLogs++
+
+		for _, e := range entries {
+			a.Transactions++
+			types[txnTypeName(e.txnType)]++
+			if e.path != "" {
+				usage(e.path).Transactions++
+			}
+			if firstTime == 0 || e.time < firstTime {
+				firstTime = e.time
+			}
+			if e.time > lastTime {
+				lastTime = e.time
+			}
+		}
+	}
+
+	if len(snapshots) == 0 && len(logs) == 0 {
+		return nil, fmt.Errorf("no snapshot or txnlog files found in %v", dataDir)
+	}
+
+	// txn times are in milliseconds
+	a.TxnLogSeconds = float64(lastTime-firstTime) / 1000
+	for name, count := range types {
+		t := txnTypeUsage{Type: name, Count: count}
+		if a.TxnLogSeconds > 0 {
+			t.PerSecond = float64(count) / a.TxnLogSeconds
+		}
+		a.TxnTypes = append(a.TxnTypes, t)
+	}
+	sort.Slice(a.TxnTypes, func(i, j int) bool {
+		if a.TxnTypes[i].Count != a.TxnTypes[j].Count {
+			return a.TxnTypes[i].Count > a.TxnTypes[j].Count
+		}
+		return a.TxnTypes[i].Type < a.TxnTypes[j].Type
+	})
+
+	for _, u := range paths {
+		a.Paths = append(a.Paths, *u)
+	}
+	sort.Slice(a.Paths, func(i, j int) bool {
+		if a.Paths[i].DataBytes != a.Paths[j].DataBytes {
+			return a.Paths[i].DataBytes > a.Paths[j].DataBytes
+		}
+		return a.Paths[i].Path < a.Paths[j].Path
+	})
+	return a, nil
+}
+
+// runAnalyze is the analyze command
+func runAnalyze(w io.Writer) error {
+	a, err := analyzeDataDir(*analyzeDataDirPath, *analyzeTxnLogDir, *analyzePathDepth, *analyzeTopN)
+	if err != nil {
+		return err
+	}
+
+	switch *analyzeFormat {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(a)
+	case "prometheus":
+		return a.writeTextfile(w)
+	default:
+		return a.writeText(w)
+	}
+}
+
+func (a *analysis) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	if a.Snapshot != "" {
+		fmt.Fprintf(tw, "snapshot\t%s\n", a.Snapshot)
+		fmt.Fprintf(tw, "sessions\t%d\n", a.Sessions)
+		fmt.Fprintf(tw, "znodes\t%d\n", a.Znodes)
+		fmt.Fprintf(tw, "ephemeral znodes\t%d\n", a.EphemeralZnodes)
+		fmt.Fprintf(tw, "data bytes\t%d\n", a.DataBytes)
+	}
+	fmt.Fprintf(tw, "txn logs\t%d\n", a.TxnLogs)
+	fmt.Fprintf(tw, "transactions\t%d over %.0fs\n", a.Transactions, a.TxnLogSeconds)
+
+	fmt.Fprintf(tw, "\nPATH\tZNODES\tDATA BYTES\tTRANSACTIONS\n")
+	for _, p := range a.Paths {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", p.Path, p.Znodes, p.DataBytes, p.Transactions)
+	}
+
+	if len(a.Largest) > 0 {
+		fmt.Fprintf(tw, "\nLARGEST ZNODE\tDATA BYTES\n")
+		for _, p := range a.Largest {
+			fmt.Fprintf(tw, "%s\t%d\n", p.Path, p.DataBytes)
+		}
+	}
+
+	if len(a.TxnTypes) > 0 {
+		fmt.Fprintf(tw, "\nTRANSACTION TYPE\tCOUNT\tPER SECOND\n")
+		for _, t := range a.TxnTypes {
+			fmt.Fprintf(tw, "%s\t%d\t%.3f\n", t.Type, t.Count, t.PerSecond)
+		}
+	}
+	return tw.Flush()
+}
+
+// writeTextfile writes the analysis in the prometheus text format, for node_exporter's textfile collector
+func (a *analysis) writeTextfile(w io.Writer) error {
+	registry := prometheus.NewRegistry()
+	gauge := func(name, help string, labels ...string) *prometheus.GaugeVec {
+		g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: prependNamespace(name), Help: help}, labels)
+		registry.MustRegister(g)
+		return g
+	}
+
+	if a.Snapshot != "" {
+		gauge("snapshot_zxid", "Zxid the analyzed snapshot is named after").WithLabelValues().Set(float64(a.SnapshotZxid))
+		gauge("snapshot_sessions", "Number of sessions in the snapshot").WithLabelValues().Set(float64(a.Sessions))
+		gauge("snapshot_znodes", "Number of znodes in the snapshot").WithLabelValues().Set(float64(a.Znodes))
+		gauge("snapshot_ephemeral_znodes", "Number of ephemeral znodes in the snapshot").WithLabelValues().Set(float64(a.EphemeralZnodes))
+		gauge("snapshot_data_bytes", "Total data size of the znodes in the snapshot in bytes").WithLabelValues().Set(float64(a.DataBytes))
+
+		znodes := gauge("snapshot_path_znodes", "Number of znodes under the path in the snapshot", "path")
+		dataBytes := gauge("snapshot_path_data_bytes", "Total data size of the znodes under the path in the snapshot in bytes", "path")
+		for _, p := range a.Paths {
+			znodes.WithLabelValues(p.Path).Set(float64(p.Znodes))
+			dataBytes.WithLabelValues(p.Path).Set(float64(p.DataBytes))
+		}
+
+		largest := gauge("snapshot_largest_znode_data_bytes", "Data size of the largest znodes in the snapshot in bytes", "path")
+		for _, p := range a.Largest {
+			largest.WithLabelValues(p.Path).Set(float64(p.DataBytes))
+		}
+	}
+
+	gauge("txnlog_files", "Number of txnlog files analyzed").WithLabelValues().Set(float64(a.TxnLogs))
+	gauge("txnlog_seconds", "Time between the first and last transaction in the txnlogs").WithLabelValues().Set(a.TxnLogSeconds)
+	pathTxns := gauge("txnlog_path_transactions", "Number of transactions under the path in the txnlogs", "path")
+	for _, p := range a.Paths {
+		if p.Transactions > 0 {
+			pathTxns.WithLabelValues(p.Path).Set(float64(p.Transactions))
+		}
+	}
+	txns := gauge("txnlog_transactions", "Number of transactions of the type in the txnlogs", "type")
+	rates := gauge("txnlog_transactions_per_second", "Average rate of transactions of the type in the txnlogs", "type")
+	for _, t := range a.TxnTypes {
+		txns.WithLabelValues(t.Type).Set(float64(t.Count))
+		rates.WithLabelValues(t.Type).Set(t.PerSecond)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSnapshot writes a snapshot holding sessions and znodes (path -> data), in the order given
+func writeSnapshot(t *testing.T, name string, sessions int, znodes [][2]string, ephemeral map[string]bool) {
+	var w juteWriter
+	w.writeInt32(snapshotMagic)
+	w.writeInt32(2)
+	w.writeInt64(-1)
+
+	w.writeInt32(int32(sessions))
+	for i := 0; i < sessions; i++ {
+		w.writeInt64(int64(i))
+		w.writeInt32(30000)
+	}
+
+	// ACL cache with world:anyone
+	w.writeInt32(1)
+	w.writeInt64(1)
+	w.writeInt32(1)
+	w.writeInt32(0x1f)
+	w.writeString("world")
+	w.writeString("anyone")
+
+	for _, z := range znodes {
+		w.writeString(z[0])
+		w.writeBuffer([]byte(z[1]))
+		w.writeInt64(1)
+		for i := 0; i < 4; i++ {
+			w.writeInt64(0)
+		}
+		for i := 0; i < 3; i++ {
+			w.writeInt32(0)
+		}
+		if ephemeral[z[0]] {
+			w.writeInt64(0x1234)
+		} else {
+			w.writeInt64(0)
+		}
+		w.writeInt64(0)
+	}
+	w.writeString("/")
+	// checksum
+	w.writeInt64(0)
+	w.writeString("/")
+
+	var out bytes.Buffer
+	if strings.HasSuffix(name, ".gz") {
+		gz := gzip.NewWriter(&out)
+		_, _ = gz.Write(w.Bytes())
+		assert.NilError(t, gz.Close())
+	} else {
+		out = w.Buffer
+	}
+	assert.NilError(t, ioutil.WriteFile(name, out.Bytes(), 0644))
+}
+
+type testTxn struct {
+	time    int64
+	txnType int32
+	path    string
+}
+
+// writeTxnLog writes a txnlog, zero padded like the preallocated files ZK writes
+func writeTxnLog(t *testing.T, name string, txns []testTxn) {
+	var w juteWriter
+	w.writeInt32(txnLogMagic)
+	w.writeInt32(2)
+	w.writeInt64(0)
+
+	for i, txn := range txns {
+		var entry juteWriter
+		entry.writeInt64(0x1234)
+		entry.writeInt32(int32(i))
+		entry.writeInt64(int64(i + 1))
+		entry.writeInt64(txn.time)
+		entry.writeInt32(txn.txnType)
+		if txn.path != "" {
+			entry.writeString(txn.path)
+			entry.writeBuffer([]byte("data"))
+		}
+
+		w.writeInt64(0)
+		w.writeBuffer(entry.Bytes())
+		w.WriteByte(txnEndOfRecord)
+	}
+	w.Write(make([]byte, 64))
+	assert.NilError(t, ioutil.WriteFile(name, w.Bytes(), 0644))
+}
+
+func TestAnalyzeDataDir(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "zkdata")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dataDir)
+	versionDir := filepath.Join(dataDir, "version-2")
+	assert.NilError(t, os.Mkdir(versionDir, 0755))
+
+	// an older snapshot, which should be ignored
+	writeSnapshot(t, filepath.Join(versionDir, "snapshot.1"), 1, [][2]string{{"", ""}}, nil)
+	writeSnapshot(t, filepath.Join(versionDir, "snapshot.1f.gz"), 3, [][2]string{
+		{"", ""},
+		{"/app1", "12345"},
+		{"/app1/config", "1234567890"},
+		{"/app1/config/big", strings.Repeat("x", 100)},
+		{"/app1/locks", ""},
+		{"/app1/locks/lock-1", "a"},
+		{"/app2", ""},
+		{"/zookeeper", ""},
+	}, map[string]bool{"/app1/locks/lock-1": true})
+
+	writeTxnLog(t, filepath.Join(versionDir, "log.1"), []testTxn{
+		{time: 1000, txnType: -10},
+		{time: 2000, txnType: 1, path: "/app1/locks/lock-1"},
+		{time: 3000, txnType: 5, path: "/app1/config"},
+	})
+	writeTxnLog(t, filepath.Join(versionDir, "log.4"), []testTxn{
+		{time: 4000, txnType: 5, path: "/app1/config/big"},
+		{time: 5000, txnType: 2, path: "/app2/gone"},
+	})
+
+	a, err := analyzeDataDir(dataDir, "", 2, 2)
+	assert.NilError(t, err)
+
+	assert.Equal(t, a.Snapshot, "snapshot.1f.gz")
+	assert.Equal(t, a.SnapshotZxid, int64(0x1f))
+	assert.Equal(t, a.Sessions, 3)
+	assert.Equal(t, a.Znodes, 8)
+	assert.Equal(t, a.EphemeralZnodes, 1)
+	assert.Equal(t, a.DataBytes, int64(116))
+	assert.DeepEqual(t, a.Largest, []pathUsage{{Path: "/app1/config/big", DataBytes: 100}, {Path: "/app1/config", DataBytes: 10}})
+	assert.DeepEqual(t, a.Paths, []pathUsage{
+		{Path: "/app1/config", Znodes: 2, DataBytes: 110, Transactions: 2},
+		{Path: "/app1", Znodes: 1, DataBytes: 5},
+		{Path: "/app1/locks", Znodes: 2, DataBytes: 1, Transactions: 1},
+		{Path: "/", Znodes: 1},
+		{Path: "/app2", Znodes: 1},
+		{Path: "/app2/gone", Transactions: 1},
+		{Path: "/zookeeper", Znodes: 1},
+	})
+
+	assert.Equal(t, a.TxnLogs, 2)
+	assert.Equal(t, a.Transactions, 5)
+	assert.Equal(t, a.TxnLogSeconds, 4.0)
+	assert.DeepEqual(t, a.TxnTypes[0], txnTypeUsage{Type: "setData", Count: 2, PerSecond: 0.5})
+	assert.Equal(t, len(a.TxnTypes), 4)
+
+	t.Run("textfile output", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.NilError(t, a.writeTextfile(&out))
+		assert.Assert(t, strings.Contains(out.String(), prependNamespace(`snapshot_path_data_bytes{path="/app1/config"} 110`)), out.String())
+		assert.Assert(t, strings.Contains(out.String(), prependNamespace(`txnlog_transactions{type="setData"} 2`)), out.String())
+	})
+
+	t.Run("empty dir", func(t *testing.T) {
+		empty, err := ioutil.TempDir("", "zkdata")
+		assert.NilError(t, err)
+		defer os.RemoveAll(empty)
+
+		_, err = analyzeDataDir(empty, "", 2, 2)
+		assert.Assert(t, err != nil)
+	})
+}
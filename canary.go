@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	canarySuccess            = "canary_success"
+	canaryCommitSeconds      = "canary_commit_seconds"
+	canaryReadSuccess        = "canary_read_success"
+	canaryReplicationLag     = "canary_replication_lag_seconds"
+	canaryCollector          = "canary"
+	canaryReadRetryInterval  = 10 * time.Millisecond
+	canaryZnodePrefix        = "canary-"
+	canarySessionTimeoutSecs = 10
+	// how long closing the sessions and deleting the znode may take once a round is over
+	canaryCleanupTimeout = 2 * time.Second
+)
+
+// canaryResult is the outcome of one canary round against an ensemble
+type canaryResult struct {
+	// the write committed, and every member we could connect to read it back
+	success bool
+	// whether the canary znode was written at all
+	written bool
+	// how long the write took to be acknowledged, i.e. committed by a quorum
+	commit time.Duration
+	// instance -> how long after the commit the member first returned the znode. Members that never did within
+	// --canary.timeout are present, with ok set to false
+	reads map[string]canaryRead
+}
+
+type canaryRead struct {
+	ok  bool
+	lag time.Duration
+}
+
+// zkCanary periodically writes a znode through one member of an ensemble and reads it back through all the others
+type zkCanary struct {
+	interval time.Duration
+	metrics  *zkMetrics
+	ensemble string
+	servers  []*zkServer
+}
+
+func newCanary(interval time.Duration, metrics *zkMetrics, ensemble string, servers []*zkServer) *zkCanary {
+	return &zkCanary{
+		interval: interval,
+		metrics:  metrics,
+		ensemble: ensemble,
+		servers:  servers,
+	}
+}
+
+// run runs a canary round every c.interval until ctx is cancelled
+func (c *zkCanary) run(ctx context.Context) {
+	for {
+		expirationTime := time.Now().Add(c.interval)
+		pollCanary(ctx, c.ensemble, c.servers, c.metrics)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(expirationTime.Sub(time.Now())):
+		}
+	}
+}
+
+// canaryEnsembles groups the servers the canary is enabled for by ensemble. AdminServer targets are left out, as the
+// canary needs the client port
+func canaryEnsembles(servers []*zkServer) map[string][]*zkServer {
+	ensembles := make(map[string][]*zkServer)
+	for _, zk := range servers {
+		if zk.ensemble == "" || zk.adminURL != "" || !zk.collectors[collectorCanary] {
+			continue
+		}
+		ensembles[zk.ensemble] = append(ensembles[zk.ensemble], zk)
+	}
+	return ensembles
+}
+
+// pollCanary runs one canary round against an ensemble and exports how it went
+func pollCanary(ctx context.Context, ensemble string, servers []*zkServer, metrics *zkMetrics) {
+	result, err := runCanary(ctx, time.Duration(*canaryTimeout)*time.Second, servers, *canaryPath)
+	if ctx.Err() == context.Canceled {
+		// stopped, e.g. by a reload
+		return
+	}
+	if err != nil {
+		log.Warnf("[%v] canary failed: %v", ensemble, err)
+	}
+	metrics.refreshCanary(ensemble, servers, result)
+}
+
+// runCanary writes an ephemeral sequential znode under parent through the first member that accepts a session, then
+// polls every other member until it returns the znode. The znode is deleted again once everybody has seen it, and
+// being ephemeral goes away with our session if we don't get that far. The round may take up to timeout; cleaning up
+// after it gets another canaryCleanupTimeout, unless pollCtx is cancelled first.
+func runCanary(pollCtx context.Context, timeout time.Duration, servers []*zkServer, parent string) (canaryResult, error) {
+	ctx, cancel := context.WithTimeout(pollCtx, timeout)
+	defer cancel()
+	cleanup := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(pollCtx, canaryCleanupTimeout)
+	}
+
+	result := canaryResult{reads: make(map[string]canaryRead)}
+	sessionTimeout := canarySessionTimeoutSecs * time.Second
+
+	var writer *zkServer
+	var wc *zkClientConn
+	var err error
+	for _, zk := range servers {
+		if wc, err = zk.openSession(ctx, sessionTimeout, false); err == nil {
+			writer = zk
+			break
+		}
+		log.Debugf("[%v] canary couldn't open a session: %v", zk.ipPort, err)
+	}
+	if writer == nil {
+		return result, fmt.Errorf("no member accepted a session, last error: %v", err)
+	}
+	// clean up even if the round timed out
+	defer func() {
+		ctx, cancel := cleanup()
+		defer cancel()
+		if err := wc.close(ctx); err != nil {
+			log.Debugf("[%v] failed to close canary session: %v", writer.ipPort, err)
+		}
+	}()
+	if err := wc.allowWrites(); err != nil {
+		return result, err
+	}
+	if err := createParents(ctx, wc, parent); err != nil {
+		return result, fmt.Errorf("failed to create %v: %v", parent, err)
+	}
+
+	// open the readers' sessions up front, so the lag isn't inflated by session establishment
+	readers := make(map[*zkServer]*zkClientConn)
+	for _, zk := range servers {
+		if zk == writer {
+			continue
+		}
+		rc, err := zk.openSession(ctx, sessionTimeout, true)
+		if err != nil {
+			log.Debugf("[%v] canary couldn't open a session: %v", zk.ipPort, err)
+			result.reads[zk.ipPort] = canaryRead{}
+			continue
+		}
+		readers[zk] = rc
+	}
+	defer func() {
+		ctx, cancel := cleanup()
+		defer cancel()
+		for zk, rc := range readers {
+			if err := rc.close(ctx); err != nil {
+				log.Debugf("[%v] failed to close canary session: %v", zk.ipPort, err)
+			}
+		}
+	}()
+
+	written := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	start := time.Now()
+	path, err := wc.create(ctx, strings.TrimRight(parent, "/")+"/"+canaryZnodePrefix, written, createEphemeralSequential)
+	if err != nil {
+		return result, fmt.Errorf("failed to write canary znode: %v", err)
+	}
+	committed := time.Now()
+	result.written = true
+	result.commit = committed.Sub(start)
+	result.reads[writer.ipPort] = canaryRead{ok: true}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for zk, rc := range readers {
+		wg.Add(1)
+		go func(zk *zkServer, rc *zkClientConn) {
+			defer wg.Done()
+
+			read := canaryRead{}
+			if err := waitForZnode(ctx, rc, path, written); err != nil {
+				log.Debugf("[%v] canary znode %v not read back: %v", zk.ipPort, path, err)
+			} else {
+				read = canaryRead{ok: true, lag: time.Since(committed)}
+			}
+
+			mu.Lock()
+			result.reads[zk.ipPort] = read
+			mu.Unlock()
+		}(zk, rc)
+	}
+	wg.Wait()
+
+	deleteCtx, cancelDelete := cleanup()
+	defer cancelDelete()
+	if err := wc.delete(deleteCtx, path); err != nil && err != zkErrNoNode {
+		log.Warnf("[%v] failed to delete canary znode %v: %v", writer.ipPort, path, err)
+	}
+
+	result.success = true
+	for instance, read := range result.reads {
+		if !read.ok {
+			result.success = false
+			log.Warnf("[%v] canary znode %v wasn't replicated to %v", writer.ipPort, path, instance)
+		}
+	}
+	return result, nil
+}
+
+// setupCanary validates the canary flags
+func setupCanary() error {
+	if !strings.HasPrefix(*canaryPath, "/") || strings.Trim(*canaryPath, "/") == "" {
+		return fmt.Errorf("invalid --canary.path %q: must be an absolute path below /", *canaryPath)
+	}
+	return nil
+}
+
+// refreshCanary stores the outcome of a canary round. The ensemble wide result is exported by collectEnsembles, the
+// reads as samples of each member
+func (m *zkMetrics) refreshCanary(ensemble string, servers []*zkServer, result canaryResult) {
+	m.mu.Lock()
+	m.canaries[ensemble] = result
+	m.mu.Unlock()
+
+	for _, zk := range servers {
+		read, ok := result.reads[zk.ipPort]
+		m.refreshExtra(zk.ipPort, canaryCollector, func() []zkSample {
+			if !ok {
+				return nil
+			}
+			success := zkSample{desc: m.descWithHelp(canaryReadSuccess, "Whether the member returned the last canary znode")}
+			if !read.ok {
+				return []zkSample{success}
+			}
+			success.value = 1
+			return []zkSample{
+				success,
+				{
+					desc:  m.descWithHelp(canaryReplicationLag, "How long after the canary write was committed the member returned it in seconds"),
+					value: read.lag.Seconds(),
+				},
+			}
+		})
+	}
+}
+
+// forgetCanary drops the result of an ensemble's canary, e.g. when it is no longer run
+func (m *zkMetrics) forgetCanary(ensemble string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.canaries, ensemble)
+}
+
+// createParents creates path and any missing parents as persistent znodes
+func createParents(ctx context.Context, c *zkClientConn, path string) error {
+	var current string
+	for _, component := range strings.Split(strings.Trim(path, "/"), "/") {
+		current += "/" + component
+		if _, err := c.create(ctx, current, nil, createPersistent); err != nil && err != zkErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForZnode polls path until it holds data, or ctx is done
+func waitForZnode(ctx context.Context, c *zkClientConn, path string, data []byte) error {
+	for {
+		got, _, err := c.getData(ctx, path)
+		switch {
+		case err == nil && string(got) == string(data):
+			return nil
+		case err == nil:
+			return fmt.Errorf("unexpected data %q", got)
+		case err != zkErrNoNode:
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(canaryReadRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"gotest.tools/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunCanary(t *testing.T) {
+	defer func(timeout int, deadline float64, enabled bool) {
+		*zkTimeout, *zkRWDeadLine, *canaryEnabled = timeout, deadline, enabled
+	}(*zkTimeout, *zkRWDeadLine, *canaryEnabled)
+	*zkTimeout, *zkRWDeadLine = 1, 1
+	*canaryEnabled = true
+
+	t.Run("members sharing a tree", func(t *testing.T) {
+		var mu sync.Mutex
+		tree := map[string][]byte{}
+		var servers []*zkServer
+		for i := 0; i < 3; i++ {
+			s := newFakeClientServer(t, &mu, tree)
+			defer s.close()
+			servers = append(servers, newZKServer(s.addr()))
+		}
+
+		result, err := runCanary(context.Background(), 5*time.Second, servers, "/exporter/canary")
+		assert.NilError(t, err)
+		assert.Assert(t, result.success)
+		assert.Assert(t, result.written)
+		assert.Equal(t, len(result.reads), 3)
+		for _, zk := range servers {
+			assert.Assert(t, result.reads[zk.ipPort].ok, zk.ipPort)
+		}
+
+		// parents are left in place, our own znode is cleaned up
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, len(tree), 2)
+		_, ok := tree["/exporter/canary"]
+		assert.Assert(t, ok)
+	})
+
+	t.Run("member that never sees the write", func(t *testing.T) {
+		writer := newFakeClientServer(t, &sync.Mutex{}, map[string][]byte{})
+		defer writer.close()
+		partitioned := newFakeClientServer(t, &sync.Mutex{}, map[string][]byte{})
+		defer partitioned.close()
+
+		// long enough for the sessions and the write even under load; the partitioned read runs until it expires
+		servers := []*zkServer{newZKServer(writer.addr()), newZKServer(partitioned.addr())}
+		result, err := runCanary(context.Background(), 500*time.Millisecond, servers, "/canary")
+		assert.NilError(t, err)
+		assert.Assert(t, result.written)
+		assert.Assert(t, !result.success)
+		assert.Assert(t, !result.reads[partitioned.addr()].ok)
+	})
+
+	t.Run("no member reachable", func(t *testing.T) {
+		s := newFakeClientServer(t, &sync.Mutex{}, map[string][]byte{})
+		s.close()
+
+		result, err := runCanary(context.Background(), 5*time.Second, []*zkServer{newZKServer(s.addr())}, "/canary")
+		assert.Assert(t, err != nil)
+		assert.Assert(t, !result.written)
+	})
+}
+
+func TestWritesDisabled(t *testing.T) {
+	defer func(timeout int, deadline float64) { *zkTimeout, *zkRWDeadLine = timeout, deadline }(*zkTimeout, *zkRWDeadLine)
+	*zkTimeout, *zkRWDeadLine = 1, 1
+	tree := map[string][]byte{}
+	s := newFakeClientServer(t, &sync.Mutex{}, tree)
+	defer s.close()
+
+	c, err := newZKServer(s.addr()).openSession(context.Background(), 10*time.Second, false)
+	assert.NilError(t, err)
+	defer c.close(context.Background())
+
+	// the canary is disabled, so writes are refused whether or not the session asked for them
+	_, err = c.create(context.Background(), "/foo", nil, createPersistent)
+	assert.Equal(t, err, errWritesDisabled)
+	assert.Equal(t, c.delete(context.Background(), "/zookeeper"), errWritesDisabled)
+
+	assert.Equal(t, c.allowWrites(), errWritesDisabled)
+	_, err = c.create(context.Background(), "/foo", nil, createPersistent)
+	assert.Equal(t, err, errWritesDisabled)
+	assert.Equal(t, len(tree), 0)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	clientProbeSuccess         = "client_probe_success"
+	clientSessionEstablishTime = "client_session_establish_seconds"
+	clientReadTime             = "client_read_seconds"
+)
+
+// probeClient does what a real client would: establish a session, read a znode and close the session. ruok only proves
+// ZK's network thread is alive, this proves clients can actually use it
+func probeClient(ctx context.Context, zk *zkServer, znode string) (session, read time.Duration, err error) {
+	start := time.Now()
+	c, err := zk.openSession(ctx, time.Duration(*clientProbeSessionTimeout)*time.Second, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	session = time.Since(start)
+
+	defer func() {
+		if err := c.close(ctx); err != nil {
+			log.Debugf("[%v] failed to close probe session: %v", zk.ipPort, err)
+		}
+	}()
+
+	start = time.Now()
+	_, err = c.exists(ctx, znode)
+	switch err {
+	case nil:
+		_, _, err = c.getData(ctx, znode)
+	case zkErrNoNode:
+		// still a successful read, just of a znode that isn't there
+		err = nil
+	}
+	if err != nil {
+		return session, 0, err
+	}
+	return session, time.Since(start), nil
+}
+
+// pollClientProbe runs the client protocol probe against a server and exports how it went
+func pollClientProbe(ctx context.Context, zk *zkServer, metrics *zkMetrics) {
+	session, read, err := probeClient(ctx, zk, *clientProbeZnode)
+	if err != nil {
+		log.Warnf("[%v] client probe failed: %v", zk.ipPort, err)
+	}
+
+	metrics.refreshExtra(zk.ipPort, clientProbeSuccess, func() []zkSample {
+		success := zkSample{desc: metrics.descWithHelp(clientProbeSuccess, "Whether a client could establish a session and read a znode")}
+		if err != nil {
+			return []zkSample{success}
+		}
+		success.value = 1
+		return []zkSample{
+			success,
+			{
+				desc:  metrics.descWithHelp(clientSessionEstablishTime, "How long establishing a client session took in seconds"),
+				value: session.Seconds(),
+			},
+			{
+				desc:  metrics.descWithHelp(clientReadTime, "How long reading the probe znode took in seconds"),
+				value: read.Seconds(),
+			},
+		}
+	})
+}
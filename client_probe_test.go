@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"gotest.tools/assert"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeClientServer speaks just enough of the client protocol for the client probe and the canary: the connect
+// handshake, exists, getData, getChildren2, create, delete and closeSession, against an in memory tree that several fake servers
+// can share, like the members of an ensemble
+type fakeClientServer struct {
+	t        *testing.T
+	listener net.Listener
+
+	mu   *sync.Mutex
+	tree map[string][]byte
+	seq  int
+	// znodes reported as ephemeral
+	ephemeral map[string]bool
+}
+
+func newFakeClientServer(t *testing.T, mu *sync.Mutex, tree map[string][]byte) *fakeClientServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+
+	s := &fakeClientServer{t: t, listener: l, mu: mu, tree: tree, ephemeral: make(map[string]bool)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeClientServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeClientServer) close() {
+	_ = s.listener.Close()
+}
+
+// children returns the names of the children of path in the tree. Caller must hold s.mu
+func (s *fakeClientServer) children(path string) []string {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	var children []string
+	for p := range s.tree {
+		if p != prefix && strings.HasPrefix(p, prefix) && !strings.Contains(p[len(prefix):], "/") {
+			children = append(children, p[len(prefix):])
+		}
+	}
+	return children
+}
+
+func (s *fakeClientServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	readPacket := func() *juteReader {
+		var length [4]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return nil
+		}
+		return newJuteReader(payload)
+	}
+	writePacket := func(w *juteWriter) {
+		var frame juteWriter
+		frame.writeBuffer(w.Bytes())
+		_, _ = conn.Write(frame.Bytes())
+	}
+	writeStat := func(w *juteWriter, path string) {
+		for i := 0; i < 4; i++ {
+			w.writeInt64(1)
+		}
+		for i := 0; i < 3; i++ {
+			w.writeInt32(0)
+		}
+		if s.ephemeral[path] {
+			w.writeInt64(0x1234)
+		} else {
+			w.writeInt64(0)
+		}
+		w.writeInt32(int32(len(s.tree[path])))
+		w.writeInt32(int32(len(s.children(path))))
+		w.writeInt64(1)
+	}
+
+	// connect
+	if r := readPacket(); r == nil {
+		return
+	}
+	var connectResp juteWriter
+	connectResp.writeInt32(0)
+	connectResp.writeInt32(10000)
+	connectResp.writeInt64(0x1234)
+	connectResp.writeBuffer(make([]byte, 16))
+	writePacket(&connectResp)
+
+	for {
+		r := readPacket()
+		if r == nil {
+			return
+		}
+		xid, op := r.readInt32(), r.readInt32()
+
+		var resp juteWriter
+		resp.writeInt32(xid)
+		resp.writeInt64(1)
+
+		s.mu.Lock()
+		switch op {
+		case opCloseSession:
+			s.mu.Unlock()
+			resp.writeInt32(0)
+			writePacket(&resp)
+			return
+		case opExists, opGetData, opGetChildren2:
+			path := r.readString()
+			data, ok := s.tree[path]
+			if !ok {
+				resp.writeInt32(int32(zkErrNoNode))
+				break
+			}
+			resp.writeInt32(0)
+			switch op {
+			case opGetData:
+				resp.writeBuffer(data)
+			case opGetChildren2:
+				children := s.children(path)
+				resp.writeInt32(int32(len(children)))
+				for _, child := range children {
+					resp.writeString(child)
+				}
+			}
+			writeStat(&resp, path)
+		case opCreate:
+			path, data := r.readString(), r.readBuffer()
+			for n := r.readInt32(); n > 0; n-- {
+				r.readInt32()
+				r.readString()
+				r.readString()
+			}
+			mode := r.readInt32()
+			if mode&2 != 0 {
+				s.seq++
+				path = fmt.Sprintf("%s%010d", path, s.seq)
+			}
+			if _, ok := s.tree[path]; ok {
+				resp.writeInt32(int32(zkErrNodeExists))
+				break
+			}
+			s.tree[path] = data
+			s.ephemeral[path] = mode&1 != 0
+			resp.writeInt32(0)
+			resp.writeString(path)
+		case opDelete:
+			path := r.readString()
+			if _, ok := s.tree[path]; !ok {
+				resp.writeInt32(int32(zkErrNoNode))
+				break
+			}
+			delete(s.tree, path)
+			resp.writeInt32(0)
+		default:
+			s.t.Errorf("unexpected op %d", op)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+		writePacket(&resp)
+	}
+}
+
+func TestProbeClient(t *testing.T) {
+	defer func(timeout int, deadline float64, sessionTimeout int) {
+		*zkTimeout, *zkRWDeadLine, *clientProbeSessionTimeout = timeout, deadline, sessionTimeout
+	}(*zkTimeout, *zkRWDeadLine, *clientProbeSessionTimeout)
+	*zkTimeout, *zkRWDeadLine, *clientProbeSessionTimeout = 1, 1, 10
+
+	for _, tc := range []struct {
+		name  string
+		znode string
+	}{
+		{"existing znode", "/zookeeper"},
+		{"missing znode still counts as a read", "/nope"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFakeClientServer(t, &sync.Mutex{}, map[string][]byte{"/zookeeper": []byte("")})
+			defer s.close()
+
+			session, read, err := probeClient(context.Background(), newZKServer(s.addr()), tc.znode)
+			assert.NilError(t, err)
+			assert.Assert(t, session > 0)
+			assert.Assert(t, read > 0)
+		})
+	}
+
+	t.Run("nothing listening", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NilError(t, err)
+		addr := l.Addr().String()
+		assert.NilError(t, l.Close())
+
+		_, _, err = probeClient(context.Background(), newZKServer(addr), "/zookeeper")
+		assert.Assert(t, err != nil)
+	})
+}
+
+func TestJuteRoundTrip(t *testing.T) {
+	var w juteWriter
+	w.writeInt32(-42)
+	w.writeInt64(1 << 40)
+	w.writeBool(true)
+	w.writeString("/zookeeper/quota")
+	w.writeBuffer(nil)
+
+	r := newJuteReader(w.Bytes())
+	assert.Equal(t, r.readInt32(), int32(-42))
+	assert.Equal(t, r.readInt64(), int64(1<<40))
+	assert.Equal(t, r.readBool(), true)
+	assert.Equal(t, r.readString(), "/zookeeper/quota")
+	assert.Assert(t, r.readBuffer() == nil)
+	assert.NilError(t, r.err)
+
+	r.readInt32()
+	assert.Equal(t, r.err, errJuteShortRead)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	scrapeDurationSeconds = "scrape_duration_seconds"
+)
+
+// zkCollector polls all zk servers at scrape time instead of in the background, so values are never stale and ZK is
+// only bothered when somebody is actually scraping us
+type zkCollector struct {
+	servers  []*zkServer
+	timeout  time.Duration
+	failures *prometheus.CounterVec
+
+	scrapeDurationDesc *prometheus.Desc
+}
+
+func newZKCollector(servers []*zkServer, timeout time.Duration, failures *prometheus.CounterVec) *zkCollector {
+	return &zkCollector{
+		servers:  servers,
+		timeout:  timeout,
+		failures: failures,
+		scrapeDurationDesc: prometheus.NewDesc(
+			prependNamespace(scrapeDurationSeconds),
+			"How long polling the zk instance took in seconds",
+			instanceLabelNames(), nil,
+		),
+	}
+}
+
+// Describe sends no descriptors, as the metrics depend on what the zk servers report
+func (c *zkCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect polls every zk server concurrently, then exports whatever came back within c.timeout
+func (c *zkCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	// fresh metrics every scrape, only the failure counter lives on between scrapes
+	metrics := newMetrics()
+	metrics.pollingFailureCounter = c.failures
+
+	var wg sync.WaitGroup
+	for _, zk := range c.servers {
+		metrics.addInstance(zk.ipPort, zk.ensemble, zk.labels...)
+		wg.Add(1)
+		go func(zk *zkServer) {
+			defer wg.Done()
+
+			start := time.Now()
+			stats, err := zk.getStats(ctx)
+			duration := time.Since(start).Seconds()
+
+			if err != nil {
+				log.Errorf("[%v] failed to get stats: %v", zk.ipPort, err)
+				c.failures.WithLabelValues(zk.metricLabels()...).Inc()
+			}
+			metrics.refresh(zk.ipPort, stats, err)
+			if err == nil {
+				pollOptional(ctx, zk, metrics)
+			}
+
+			ch <- prometheus.MustNewConstMetric(c.scrapeDurationDesc, prometheus.GaugeValue, duration, zk.metricLabels()...)
+		}(zk)
+	}
+	wg.Wait()
+
+	for ensemble, servers := range canaryEnsembles(c.servers) {
+		wg.Add(1)
+		go func(ensemble string, servers []*zkServer) {
+			defer wg.Done()
+			pollCanary(ctx, ensemble, servers, metrics)
+		}(ensemble, servers)
+	}
+	wg.Wait()
+
+	metrics.Collect(ch)
+}
+
+// scrapeHandler serves /metrics in scrape mode. Each request gets its own zkCollector for the current targets, bounded
+// by the scrape timeout prometheus tells us about
+func scrapeHandler(tm *targetManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout, _, err := scrapeTimeout(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(newZKCollector(tm.current(), timeout, tm.failures))
+
+		gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+		promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestZKCollector(t *testing.T) {
+	t.Run("unreachable server is reported as down", func(t *testing.T) {
+		// grab a free port, then close it so nothing is listening
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NilError(t, err)
+		addr := l.Addr().String()
+		assert.NilError(t, l.Close())
+
+		failures := newFailureCounter()
+		c := newZKCollector([]*zkServer{newZKServer(addr)}, time.Second, failures)
+
+		want := `
+# HELP up Whether the zk instance answered the last poll
+# TYPE up gauge
+up{zk_instance="` + addr + `"} 0
+`
+		assert.NilError(t, testutil.CollectAndCompare(c, strings.NewReader(want), "up"))
+		assert.Equal(t, testutil.ToFloat64(failures.WithLabelValues(addr)), float64(1))
+	})
+}
+
+func TestScrapeHandler(t *testing.T) {
+	f, zk := startFakeZK(t)
+	defer f.close()
+	zk.rwDeadline = 5 * time.Second
+	tm := newTargetManager(nil)
+	tm.apply([]*zkServer{zk})
+	defer tm.stopAll()
+	instance := `{zk_instance="` + zk.ipPort + `"}`
+
+	scrape := func(timeout string) string {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if timeout != "" {
+			req.Header.Set(scrapeTimeoutHeader, timeout)
+		}
+		rr := httptest.NewRecorder()
+		scrapeHandler(tm).ServeHTTP(rr, req)
+		assert.Equal(t, rr.Code, http.StatusOK)
+		return rr.Body.String()
+	}
+
+	t.Run("polls the targets", func(t *testing.T) {
+		body := scrape("")
+		assert.Assert(t, strings.Contains(body, "\nup"+instance+" 1\n"), body)
+		assert.Assert(t, strings.Contains(body, "\nscrape_duration_seconds"+instance+" "), body)
+	})
+
+	t.Run("the scrape timeout header bounds the poll", func(t *testing.T) {
+		f.setDelay(2 * time.Second)
+		defer f.setDelay(0)
+
+		start := time.Now()
+		body := scrape("0.2")
+		assert.Assert(t, time.Since(start) < time.Second, "scrape took %v", time.Since(start))
+		assert.Assert(t, strings.Contains(body, "\nup"+instance+" 0\n"), body)
+	})
+}
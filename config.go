@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// names of the optional collectors, as used in the config file
+const (
+	collectorZxid        = "zxid"
+	collectorCons        = "cons"
+	collectorWchs        = "wchs"
+	collectorWchc        = "wchc"
+	collectorWchp        = "wchp"
+	collectorClientProbe = "client_probe"
+	collectorCanary      = "canary"
+	collectorTree        = "tree"
+)
+
+// collectorSet holds the optional collectors enabled for a server
+type collectorSet map[string]bool
+
+// the collectors enabled by the --collector.* flags
+func flagCollectors() collectorSet {
+	return collectorSet{
+		collectorZxid:        *zxidEnabled,
+		collectorCons:        *consEnabled,
+		collectorWchs:        *wchsEnabled,
+		collectorWchc:        *wchcEnabled,
+		collectorWchp:        *wchpEnabled,
+		collectorClientProbe: *clientProbeEnabled,
+		collectorCanary:      *canaryEnabled,
+		collectorTree:        *treeEnabled,
+	}
+}
+
+// names of the labels from the config file, added to every per instance and ensemble metric. Every target gets all of
+// them, with empty values for labels its ensemble doesn't set, as all metrics of a name need the same label names
+var targetLabelNames []string
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// fileConfig is the --config.file
+type fileConfig struct {
+	Ensembles []ensembleConfig `yaml:"ensembles"`
+}
+
+// ensembleConfig describes one ensemble. Anything left out defaults to the flags
+type ensembleConfig struct {
+	Name           string            `yaml:"name"`
+	Members        []string          `yaml:"members"`
+	Labels         map[string]string `yaml:"labels"`
+	PollInterval   time.Duration     `yaml:"poll_interval"`
+	ConnectTimeout time.Duration     `yaml:"connect_timeout"`
+	ReadTimeout    time.Duration     `yaml:"read_timeout"`
+	Collectors     *[]string         `yaml:"collectors"`
+	TLS            *tlsFileConfig    `yaml:"tls"`
+}
+
+type tlsFileConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"`
+	MinVersion string `yaml:"min_version"`
+}
+
+// reservedLabels returns the label names the exporter uses itself, which the config file can't use: those its
+// metrics are declared with, and those of the info metrics mntr reports, like zk_version
+func reservedLabels() map[string]bool {
+	reserved := make(map[string]bool)
+	for name := range usedLabels {
+		reserved[name] = true
+	}
+	for key, typ := range metricTypes {
+		if typ == infoMetric {
+			reserved[sanitiseMetricName(key)] = true
+		}
+	}
+	return reserved
+}
+
+// loadConfigFile reads and validates a config file
+func loadConfigFile(name string) (*fileConfig, error) {
+	byts, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &fileConfig{}
+	if err := yaml.UnmarshalStrict(byts, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", name, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %v: %v", name, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *fileConfig) validate() error {
+	if len(cfg.Ensembles) == 0 {
+		return fmt.Errorf("no ensembles defined")
+	}
+
+	reserved := reservedLabels()
+	ensembles := make(map[string]bool)
+	members := make(map[string]string)
+	for i, e := range cfg.Ensembles {
+		if e.Name == "" {
+			return fmt.Errorf("ensemble #%d has no name", i+1)
+		}
+		if ensembles[e.Name] {
+			return fmt.Errorf("ensemble %q is defined more than once", e.Name)
+		}
+		ensembles[e.Name] = true
+
+		if len(e.Members) == 0 {
+			return fmt.Errorf("ensemble %q has no members", e.Name)
+		}
+		for _, member := range e.Members {
+			if err := checkTarget(member); err != nil {
+				return fmt.Errorf("ensemble %q: member %v", e.Name, err)
+			}
+			if other, ok := members[member]; ok {
+				return fmt.Errorf("ensemble %q: member %q is already a member of ensemble %q", e.Name, member, other)
+			}
+			members[member] = e.Name
+		}
+
+		for name := range e.Labels {
+			if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+				return fmt.Errorf("ensemble %q: %q is not a valid label name", e.Name, name)
+			}
+			if reserved[name] {
+				return fmt.Errorf("ensemble %q: label %q is used by the exporter itself", e.Name, name)
+			}
+		}
+
+		for field, d := range map[string]time.Duration{
+			"poll_interval":   e.PollInterval,
+			"connect_timeout": e.ConnectTimeout,
+			"read_timeout":    e.ReadTimeout,
+		} {
+			if d < 0 {
+				return fmt.Errorf("ensemble %q: %v must not be negative", e.Name, field)
+			}
+		}
+
+		collectors := e.collectors()
+		for name := range collectors {
+			if _, ok := flagCollectors()[name]; !ok {
+				return fmt.Errorf("ensemble %q: unknown collector %q", e.Name, name)
+			}
+		}
+		if collectors[collectorTree] && len(treeRoots) == 0 {
+			return fmt.Errorf("ensemble %q: the tree collector needs at least one --tree.roots path", e.Name)
+		}
+
+		if _, err := e.tlsConfig(); err != nil {
+			return fmt.Errorf("ensemble %q: invalid tls: %v", e.Name, err)
+		}
+	}
+	return nil
+}
+
+// collectors returns the collectors enabled for the ensemble: the listed ones if there is a list, the flags' otherwise
+func (e ensembleConfig) collectors() collectorSet {
+	if e.Collectors == nil {
+		return flagCollectors()
+	}
+	collectors := make(collectorSet)
+	for _, name := range *e.Collectors {
+		collectors[name] = true
+	}
+	return collectors
+}
+
+// tlsConfig returns the TLS config for the ensemble's members: built from the tls section if there is one, the
+// --zk.tls.* flags' otherwise
+func (e ensembleConfig) tlsConfig() (*tls.Config, error) {
+	if e.TLS == nil {
+		return zkTLSConfig, nil
+	}
+	if !e.TLS.Enabled {
+		return nil, nil
+	}
+	minVersion := e.TLS.MinVersion
+	if minVersion == "" {
+		minVersion = *zkTLSMinVersion
+	}
+	return newTLSConfig(e.TLS.CAFile, e.TLS.CertFile, e.TLS.KeyFile, e.TLS.ServerName, minVersion)
+}
+
+// labelNames returns the sorted names of all labels used by any ensemble
+func (cfg *fileConfig) labelNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range cfg.Ensembles {
+		for name := range e.Labels {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// servers builds a zkServer for every member of every ensemble, with the values of the labelNames labels
+func (cfg *fileConfig) servers(labelNames []string) ([]*zkServer, error) {
+	var servers []*zkServer
+	for _, e := range cfg.Ensembles {
+		tlsConfig, err := e.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range e.Members {
+			zk := newZKServer(member)
+			zk.ensemble = e.Name
+			zk.labels = make([]string, len(labelNames))
+			for i, name := range labelNames {
+				zk.labels[i] = e.Labels[name]
+			}
+			if e.PollInterval > 0 {
+				zk.pollInterval = e.PollInterval
+			}
+			if e.ConnectTimeout > 0 {
+				zk.connectTimeout = e.ConnectTimeout
+			}
+			if e.ReadTimeout > 0 {
+				zk.rwDeadline = e.ReadTimeout
+			}
+			zk.collectors = e.collectors()
+			zk.tlsFile, zk.tlsConfig, zk.httpClient = e.TLS, tlsConfig, newHTTPClient(tlsConfig)
+			servers = append(servers, zk)
+		}
+	}
+	return servers, nil
+}
+
+// loadTargets returns the servers to poll: those of the --config.file if there is one, the --zk.hosts otherwise. On
+// startup it sets targetLabelNames, which must be done before the metrics are created. Later on, when reloading, the
+// label names can't change any more: it's an error for the config file to introduce new ones.
+func loadTargets(startup bool) ([]*zkServer, error) {
+	if *configFile != "" {
+		if *zkHostString != "" {
+			return nil, fmt.Errorf("--zk.hosts and --config.file can't be used together")
+		}
+		cfg, err := loadConfigFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if startup {
+			targetLabelNames = cfg.labelNames()
+		}
+		known := make(map[string]bool)
+		for _, name := range targetLabelNames {
+			known[name] = true
+		}
+		for _, name := range cfg.labelNames() {
+			if !known[name] {
+				return nil, fmt.Errorf("new label %q needs a restart", name)
+			}
+		}
+		return cfg.servers(targetLabelNames)
+	}
+
+	var servers []*zkServer
+	if *zkHostString == "" {
+		return servers, nil
+	}
+	for _, ipport := range strings.Split(*zkHostString, ",") {
+		if err := checkTarget(ipport); err != nil {
+			return nil, fmt.Errorf("zookeeper host %v", err)
+		}
+		zk := newZKServer(ipport)
+		zk.ensemble = *ensembleName
+		servers = append(servers, zk)
+	}
+	return servers, nil
+}
+
+// runCheckConfig is the check-config command
+func runCheckConfig() error {
+	if *configFile == "" {
+		return fmt.Errorf("--config.file is required")
+	}
+	cfg, err := loadConfigFile(*configFile)
+	if err != nil {
+		return err
+	}
+
+	members := 0
+	for _, e := range cfg.Ensembles {
+		members += len(e.Members)
+	}
+	log.Infof("%v is valid: %d ensembles with %d members", *configFile, len(cfg.Ensembles), members)
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "zookeeper_exporter*.yml")
+	assert.NilError(t, err)
+	_, err = f.WriteString(content)
+	assert.NilError(t, err)
+	assert.NilError(t, f.Close())
+	return f.Name()
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	defer func(interval, timeout int, deadline float64, labelNames []string) {
+		*pollInterval, *zkTimeout, *zkRWDeadLine, targetLabelNames = interval, timeout, deadline, labelNames
+	}(*pollInterval, *zkTimeout, *zkRWDeadLine, targetLabelNames)
+	*pollInterval, *zkTimeout, *zkRWDeadLine = 30, 5, 5
+
+	name := writeConfig(t, `
+ensembles:
+  - name: prod-a
+    members: [10.0.0.1:2181, 10.0.0.2:2181]
+    labels: {env: prod, dc: ams}
+    poll_interval: 15s
+    connect_timeout: 2s
+    read_timeout: 3s
+    collectors: [cons, client_probe]
+  - name: staging
+    members: [http://10.0.1.1:8080]
+    labels: {env: staging, cluster: b}
+    collectors: []
+`)
+	defer os.Remove(name)
+
+	cfg, err := loadConfigFile(name)
+	assert.NilError(t, err)
+	targetLabelNames = cfg.labelNames()
+	assert.DeepEqual(t, targetLabelNames, []string{"cluster", "dc", "env"})
+	servers, err := cfg.servers(targetLabelNames)
+	assert.NilError(t, err)
+
+	assert.Equal(t, len(servers), 3)
+
+	prod := servers[1]
+	assert.Equal(t, prod.ipPort, "10.0.0.2:2181")
+	assert.Equal(t, prod.ensemble, "prod-a")
+	assert.DeepEqual(t, prod.labels, []string{"", "ams", "prod"})
+	assert.Equal(t, prod.pollInterval, 15*time.Second)
+	assert.Equal(t, prod.connectTimeout, 2*time.Second)
+	assert.Equal(t, prod.rwDeadline, 3*time.Second)
+	assert.Assert(t, prod.collectors[collectorCons])
+	assert.Assert(t, prod.collectors[collectorClientProbe])
+	assert.Assert(t, !prod.collectors[collectorCanary])
+
+	staging := servers[2]
+	assert.Equal(t, staging.adminURL, "http://10.0.1.1:8080")
+	assert.DeepEqual(t, staging.labels, []string{"b", "", "staging"})
+	// defaults from the flags
+	assert.Equal(t, staging.pollInterval, 30*time.Second)
+	assert.Equal(t, staging.connectTimeout, 5*time.Second)
+	assert.Equal(t, len(staging.collectors), 0)
+
+	t.Run("labels are added to the metrics", func(t *testing.T) {
+		m := newMetrics()
+		m.addInstance(prod.ipPort, prod.ensemble, prod.labels...)
+		m.refresh(prod.ipPort, map[string]string{zkAvgLatency: "3"}, nil)
+
+		want := `
+# HELP zk_avg_latency Average Latency for ZooKeeper network requests
+# TYPE zk_avg_latency gauge
+zk_avg_latency{cluster="",dc="ams",env="prod",zk_instance="10.0.0.2:2181"} 3
+# HELP ensemble_members Number of configured members of the ensemble
+# TYPE ensemble_members gauge
+ensemble_members{cluster="",dc="ams",ensemble="prod-a",env="prod"} 1
+`
+		assert.NilError(t, testutil.CollectAndCompare(m, strings.NewReader(want), "zk_avg_latency", "ensemble_members"))
+	})
+}
+
+func TestInvalidConfigFile(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"no ensembles", `ensembles: []`, "no ensembles defined"},
+		{"typo", `
+ensembles:
+  - name: a
+    memebers: [10.0.0.1:2181]
+`, "field memebers not found"},
+		{"no name", `
+ensembles:
+  - members: [10.0.0.1:2181]
+`, "ensemble #1 has no name"},
+		{"duplicate name", `
+ensembles:
+  - {name: a, members: [10.0.0.1:2181]}
+  - {name: a, members: [10.0.0.2:2181]}
+`, `ensemble "a" is defined more than once`},
+		{"no members", `
+ensembles:
+  - name: a
+`, `ensemble "a" has no members`},
+		{"bad member", `
+ensembles:
+  - {name: a, members: [zk1]}
+`, `ensemble "a": member "zk1" is not ip:port`},
+		{"dns member without port", `
+ensembles:
+  - {name: a, members: [dns+zk-headless]}
+`, `ensemble "a": member "dns+zk-headless" is not dns+host:port`},
+		{"member of two ensembles", `
+ensembles:
+  - {name: a, members: [10.0.0.1:2181]}
+  - {name: b, members: [10.0.0.1:2181]}
+`, `ensemble "b": member "10.0.0.1:2181" is already a member of ensemble "a"`},
+		{"bad label name", `
+ensembles:
+  - {name: a, members: [10.0.0.1:2181], labels: {data-center: ams}}
+`, `ensemble "a": "data-center" is not a valid label name`},
+		{"reserved label", `
+ensembles:
+  - {name: a, members: [10.0.0.1:2181], labels: {zk_instance: foo}}
+`, `ensemble "a": label "zk_instance" is used by the exporter itself`},
+		{"reserved summary label", `
+ensembles:
+  - {name: a, members: [10.0.0.1:2181], labels: {quantile: "0.5"}}
+`, `ensemble "a": label "quantile" is used by the exporter itself`},
+		{"bad duration", `
+ensembles:
+  - {name: a, members: [10.0.0.1:2181], poll_interval: often}
+`, "failed to parse"},
+		{"unknown collector", `
+ensembles:
+  - {name: a, members: [10.0.0.1:2181], collectors: [cons, mntr]}
+`, `ensemble "a": unknown collector "mntr"`},
+		{"bad tls", `
+ensembles:
+  - {name: a, members: [10.0.0.1:2181], tls: {enabled: true, min_version: "0.9"}}
+`, `ensemble "a": invalid tls: unknown TLS version "0.9"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := writeConfig(t, tc.config)
+			defer os.Remove(name)
+
+			_, err := loadConfigFile(name)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	consCMD = "cons"
+
+	clientConnections         = "client_connections"
+	clientPacketsReceived     = "client_packets_received"
+	clientPacketsSent         = "client_packets_sent"
+	clientOutstandingRequests = "client_outstanding_requests"
+	clientMaxLatency          = "client_max_latency"
+
+	// client_ip of the clients that didn't make the --cons.max-clients cut
+	otherClients = "other"
+)
+
+// parsed --cons.allow-cidrs / --cons.deny-cidrs, see setupConsFilters()
+var consAllowNets, consDenyNets []*net.IPNet
+
+// consConnection is one line of cons output, e.g.
+// /10.0.0.5:51234[1](queued=0,recved=10,sent=10,sid=0x100007f8a4e0001,lop=PING,est=1617000000000,to=30000,...,maxlat=2)
+type consConnection struct {
+	clientIP   string
+	queued     float64
+	received   float64
+	sent       float64
+	sid        string
+	lastOp     string
+	maxLatency float64
+}
+
+// what we export per client IP
+type clientStats struct {
+	clientIP    string
+	connections float64
+	received    float64
+	sent        float64
+	outstanding float64
+	maxLatency  float64
+}
+
+// parseCIDRs parses a comma separated list of CIDRs, as given to --cons.allow-cidrs / --cons.deny-cidrs
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCons parses the connection lines of cons output, skipping anything it doesn't understand
+func parseCons(byts []byte) []consConnection {
+	var conns []consConnection
+
+	scanner := bufio.NewScanner(bytes.NewReader(byts))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "/") {
+			continue
+		}
+
+		lparen, rparen := strings.Index(line, "("), strings.LastIndex(line, ")")
+		bracket := strings.Index(line, "[")
+		if lparen < 0 || rparen < lparen || bracket < 0 || bracket > lparen {
+			continue
+		}
+
+		// address is ip:port, ip may be IPv6 so split on the last colon
+		addr := line[1:bracket]
+		colon := strings.LastIndex(addr, ":")
+		if colon < 0 {
+			continue
+		}
+		conn := consConnection{clientIP: addr[:colon]}
+
+		for _, kv := range strings.Split(line[lparen+1:rparen], ",") {
+			splits := strings.SplitN(kv, "=", 2)
+			if len(splits) != 2 {
+				continue
+			}
+			key, value := splits[0], splits[1]
+			switch key {
+			case "sid":
+				conn.sid = value
+			case "lop":
+				conn.lastOp = value
+			case "queued", "recved", "sent", "maxlat":
+				f, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					continue
+				}
+				switch key {
+				case "queued":
+					conn.queued = f
+				case "recved":
+					conn.received = f
+				case "sent":
+					conn.sent = f
+				case "maxlat":
+					conn.maxLatency = f
+				}
+			}
+		}
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// aggregateClients sums up connections per client IP. Clients outside allow (if set) or inside deny are dropped, and
+// only the maxClients clients with the most connections are kept; the rest are lumped together as "other"
+func aggregateClients(conns []consConnection, allow, deny []*net.IPNet, maxClients int) []*clientStats {
+	byIP := make(map[string]*clientStats)
+	for _, conn := range conns {
+		ip := net.ParseIP(conn.clientIP)
+		if ip == nil {
+			continue
+		}
+		if (len(allow) > 0 && !containsIP(allow, ip)) || containsIP(deny, ip) {
+			continue
+		}
+
+		c, ok := byIP[conn.clientIP]
+		if !ok {
+			c = &clientStats{clientIP: conn.clientIP}
+			byIP[conn.clientIP] = c
+		}
+		c.add(conn)
+	}
+
+	clients := make([]*clientStats, 0, len(byIP))
+	for _, c := range byIP {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].connections != clients[j].connections {
+			return clients[i].connections > clients[j].connections
+		}
+		return clients[i].clientIP < clients[j].clientIP
+	})
+
+	if maxClients <= 0 || len(clients) <= maxClients {
+		return clients
+	}
+
+	other := &clientStats{clientIP: otherClients}
+	for _, c := range clients[maxClients:] {
+		other.connections += c.connections
+		other.received += c.received
+		other.sent += c.sent
+		other.outstanding += c.outstanding
+		if c.maxLatency > other.maxLatency {
+			other.maxLatency = c.maxLatency
+		}
+	}
+	return append(clients[:maxClients], other)
+}
+
+func (c *clientStats) add(conn consConnection) {
+	c.connections++
+	c.received += conn.received
+	c.sent += conn.sent
+	c.outstanding += conn.queued
+	if conn.maxLatency > c.maxLatency {
+		c.maxLatency = conn.maxLatency
+	}
+}
+
+func (zk *zkServer) getCons(ctx context.Context) ([]consConnection, error) {
+	byts, err := zk.sendWhitelistedCommand(ctx, consCMD)
+	if err != nil {
+		return nil, err
+	}
+	return parseCons(byts), nil
+}
+
+// pollCons refreshes the per client metrics of a server
+func pollCons(ctx context.Context, zk *zkServer, metrics *zkMetrics) {
+	conns, err := zk.getCons(ctx)
+	if err != nil {
+		log.Warnf("[%v] failed to get cons: %v", zk.ipPort, err)
+		// drop whatever we exported before, so it doesn't look current
+		metrics.refreshCons(zk.ipPort, nil)
+		return
+	}
+	clients := aggregateClients(conns, consAllowNets, consDenyNets, *consMaxClients)
+	metrics.refreshCons(zk.ipPort, clients)
+}
+
+var clientLabels = exporterLabels("client_ip")
+
+// refreshCons converts aggregated cons output into per client IP metrics
+func (m *zkMetrics) refreshCons(instance string, clients []*clientStats) {
+	m.refreshExtra(instance, consCMD, func() []zkSample {
+		connections := m.descWithHelp(clientConnections, "Number of connections from the client IP, from the cons command", clientLabels...)
+		received := m.descWithHelp(clientPacketsReceived, "Packets received from the client IP's connections", clientLabels...)
+		sent := m.descWithHelp(clientPacketsSent, "Packets sent to the client IP's connections", clientLabels...)
+		outstanding := m.descWithHelp(clientOutstandingRequests, "Requests queued for the client IP's connections", clientLabels...)
+		maxLatency := m.descWithHelp(clientMaxLatency, "Maximum latency of the client IP's connections (ms)", clientLabels...)
+
+		samples := make([]zkSample, 0, len(clients)*5)
+		for _, c := range clients {
+			labels := []string{c.clientIP}
+			samples = append(samples,
+				zkSample{desc: connections, value: c.connections, labels: labels},
+				zkSample{desc: received, value: c.received, labels: labels},
+				zkSample{desc: sent, value: c.sent, labels: labels},
+				zkSample{desc: outstanding, value: c.outstanding, labels: labels},
+				zkSample{desc: maxLatency, value: c.maxLatency, labels: labels},
+			)
+		}
+		return samples
+	})
+}
+
+// parses the --cons.* CIDR flags, called once on startup
+func setupConsFilters() error {
+	var err error
+	if consAllowNets, err = parseCIDRs(*consAllowCIDRs); err != nil {
+		return fmt.Errorf("invalid --cons.allow-cidrs: %v", err)
+	}
+	if consDenyNets, err = parseCIDRs(*consDenyCIDRs); err != nil {
+		return fmt.Errorf("invalid --cons.deny-cidrs: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	"testing"
+)
+
+const testCons = ` /10.0.0.5:51234[1](queued=0,recved=10,sent=10,sid=0x100007f8a4e0001,lop=PING,est=1617000000000,to=30000,lcxid=0x2,lzxid=0xffffffffffffffff,lresp=1617000001000,llat=0,minlat=0,avglat=0,maxlat=2)
+ /10.0.0.5:51235[1](queued=3,recved=20,sent=19,sid=0x100007f8a4e0002,lop=GETD,est=1617000000000,to=30000,lcxid=0x5,lzxid=0x100000004,lresp=1617000001000,llat=1,minlat=0,avglat=1,maxlat=7)
+ /10.0.1.9:40000[1](queued=0,recved=5,sent=5,sid=0x100007f8a4e0003,lop=PING,est=1617000000000,to=30000,lcxid=0x1,lzxid=0xffffffffffffffff,lresp=1617000001000,llat=0,minlat=0,avglat=0,maxlat=1)
+ /0:0:0:0:0:0:0:1:54132[0](queued=0,recved=1,sent=0)
+
+`
+
+func TestParseCons(t *testing.T) {
+	conns := parseCons([]byte(testCons))
+	assert.Equal(t, len(conns), 4)
+	assert.Equal(t, conns[1], consConnection{
+		clientIP:   "10.0.0.5",
+		queued:     3,
+		received:   20,
+		sent:       19,
+		sid:        "0x100007f8a4e0002",
+		lastOp:     "GETD",
+		maxLatency: 7,
+	})
+	assert.Equal(t, conns[3].clientIP, "0:0:0:0:0:0:0:1")
+}
+
+func TestAggregateClients(t *testing.T) {
+	conns := parseCons([]byte(testCons))
+
+	t.Run("per client IP", func(t *testing.T) {
+		clients := aggregateClients(conns, nil, nil, 0)
+		assert.Equal(t, len(clients), 3)
+		assert.Equal(t, *clients[0], clientStats{
+			clientIP:    "10.0.0.5",
+			connections: 2,
+			received:    30,
+			sent:        29,
+			outstanding: 3,
+			maxLatency:  7,
+		})
+	})
+
+	t.Run("cardinality cap", func(t *testing.T) {
+		clients := aggregateClients(conns, nil, nil, 1)
+		assert.Equal(t, len(clients), 2)
+		assert.Equal(t, clients[1].clientIP, otherClients)
+		assert.Equal(t, clients[1].connections, float64(2))
+	})
+
+	t.Run("allow and deny lists", func(t *testing.T) {
+		allow, err := parseCIDRs("10.0.0.0/16")
+		assert.NilError(t, err)
+		deny, err := parseCIDRs("10.0.1.0/24, ")
+		assert.NilError(t, err)
+
+		clients := aggregateClients(conns, allow, deny, 0)
+		assert.Equal(t, len(clients), 1)
+		assert.Equal(t, clients[0].clientIP, "10.0.0.5")
+	})
+
+	t.Run("bad CIDR", func(t *testing.T) {
+		_, err := parseCIDRs("10.0.0.0/99")
+		assert.Assert(t, err != nil)
+	})
+}
+
+func TestPollCons(t *testing.T) {
+	f, zk := startFakeZK(t)
+	defer f.close()
+	metrics := newMetrics()
+	metrics.refresh(zk.ipPort, map[string]string{zkOK: "imok"}, nil)
+
+	pollCons(context.Background(), zk, metrics)
+	assert.Equal(t, testutil.CollectAndCount(metrics, clientConnections), 1)
+
+	// a failed cons drops the series rather than leaving them stale
+	f.setResponse(consCMD, "cons is not executed because it is not in the whitelist.\n")
+	pollCons(context.Background(), zk, metrics)
+	assert.Equal(t, testutil.CollectAndCount(metrics, clientConnections), 0)
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	consul "github.com/hashicorp/consul/api"
 	"strconv"
 	"strings"
@@ -14,6 +16,9 @@ type ServiceRegistrar struct {
 	Tags        []string
 	TTLSeconds  int
 	ConsulAgent *consul.Agent
+
+	// runs updateCheckTTLForever once registered
+	heartbeat *runner
 }
 
 func NewServiceRegistrar(name, addr, consulTags string, consulTTL int) (*ServiceRegistrar, error) {
@@ -60,42 +65,52 @@ func (sr *ServiceRegistrar) RegisterService() error {
 	return nil
 }
 
-// Sends heartbeats to consul health check
-func (sr *ServiceRegistrar) updateCheckTTLForever() {
+// Sends heartbeats to consul health check, until ctx is cancelled
+func (sr *ServiceRegistrar) updateCheckTTLForever(ctx context.Context) {
 	// TTL heartbeat every TTL / 2
 	ticker := time.NewTicker(time.Duration(sr.TTLSeconds) * time.Second / 2)
-	for range ticker.C {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		if err := sr.ConsulAgent.UpdateTTL("service:"+sr.Name, "output", "pass"); err != nil {
 			log.Errorf("failed to updateTTL: %v", err)
 		}
 	}
 }
 
-// Deregisters us from consul
-func (sr *ServiceRegistrar) deRegister() {
-	if err := sr.ConsulAgent.ServiceDeregister("service:" + sr.Name); err != nil {
-		log.Errorf("failed to deregister with consul: %v", err)
+// Stops the heartbeats and deregisters us from consul. We register without an ID, so consul uses the name as the
+// service ID (and "service:" + the name as the check ID)
+func (sr *ServiceRegistrar) deRegister() error {
+	if sr.heartbeat != nil {
+		sr.heartbeat.stop()
+		sr.heartbeat = nil
 	}
+	return sr.ConsulAgent.ServiceDeregister(sr.Name)
 }
 
-// main registration func, sets up registration structs, registers, runs updateCheckTTLForever
-func registerWithConsulAgent(serviceName, serviceTags, consulBindHostPort string, serviceTTL int) error {
-	if serviceName != "" {
-		log.Infof("attempting to register service %v with consul", serviceName)
+// main registration func, sets up registration structs, registers, runs updateCheckTTLForever. Returns nil if
+// serviceName is empty, so there's nothing to deregister on shutdown
+func registerWithConsulAgent(serviceName, serviceTags, consulBindHostPort string, serviceTTL int) (*ServiceRegistrar, error) {
+	if serviceName == "" {
+		log.Debugf("not registering with consul; consul.service-name flag undefined")
+		return nil, nil
+	}
+	log.Infof("attempting to register service %v with consul", serviceName)
 
-		// Creates a new ServiceRegistrar struct
-		sr, err := NewServiceRegistrar(serviceName, consulBindHostPort, serviceTags, serviceTTL)
-		if err != nil {
-			log.Fatalf("failed to create consul service registrar: %v", err)
-		}
+	// Creates a new ServiceRegistrar struct
+	sr, err := NewServiceRegistrar(serviceName, consulBindHostPort, serviceTags, serviceTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consul service registrar: %v", err)
+	}
 
-		// Register the service
-		if err := sr.RegisterService(); err != nil {
-			log.Fatalf("failed to register service with consul: %v", err)
-		}
-		go sr.updateCheckTTLForever()
-	} else {
-		log.Debugf("not registering with consul; consul.service-name flag undefined")
+	// Register the service
+	if err := sr.RegisterService(); err != nil {
+		return nil, fmt.Errorf("failed to register service with consul: %v", err)
 	}
-	return nil
+	sr.heartbeat = startRunner(sr.updateCheckTTLForever)
+	return sr, nil
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// how long a blocking catalog query waits for a change before returning anyway
+	consulSDWaitTime = 5 * time.Minute
+	// how long to wait before retrying a failed catalog query
+	consulSDRetryInterval = 5 * time.Second
+)
+
+var invalidLabelCharRE = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// consulDiscoverer finds the ZK servers to poll in the consul catalog: every instance of a service, optionally with a
+// tag. It watches the service with blocking queries, so changes are picked up as soon as consul knows about them.
+type consulDiscoverer struct {
+	catalog      *consul.Catalog
+	service      string
+	tag          string
+	ensembleMeta string
+	// the service meta keys whose values become the labels, in targetLabelNames order
+	metaKeys []string
+	retry    time.Duration
+}
+
+// newConsulDiscoverer sets up discovery from the --consul.sd.* flags, and sets targetLabelNames to the names of the
+// --consul.sd.meta-labels, which must be done before the metrics are created
+func newConsulDiscoverer() (*consulDiscoverer, error) {
+	if *zkHostString != "" || *configFile != "" || *fileSDFiles != "" {
+		return nil, fmt.Errorf("--consul.sd.service can't be used along with --zk.hosts, --config.file or --file-sd.files")
+	}
+
+	c, err := consul.NewClient(consul.DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	d := &consulDiscoverer{
+		catalog:      c.Catalog(),
+		service:      *consulSDService,
+		tag:          *consulSDTag,
+		ensembleMeta: *consulSDEnsembleMeta,
+		retry:        consulSDRetryInterval,
+	}
+
+	keys := make(map[string]string)
+	reserved := reservedLabels()
+	targetLabelNames = nil
+	for _, key := range strings.Split(*consulSDMetaLabels, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		// consul allows dashes in meta keys, prometheus doesn't in label names
+		name := invalidLabelCharRE.ReplaceAllString(key, "_")
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid --consul.sd.meta-labels: %q is not a valid label name", name)
+		}
+		if reserved[name] {
+			return nil, fmt.Errorf("invalid --consul.sd.meta-labels: label %q is used by the exporter itself", name)
+		}
+		if other, ok := keys[name]; ok {
+			return nil, fmt.Errorf("invalid --consul.sd.meta-labels: %q and %q are both label %q", other, key, name)
+		}
+		keys[name] = key
+		targetLabelNames = append(targetLabelNames, name)
+	}
+	sort.Strings(targetLabelNames)
+	for _, name := range targetLabelNames {
+		d.metaKeys = append(d.metaKeys, keys[name])
+	}
+	return d, nil
+}
+
+func (d *consulDiscoverer) String() string {
+	if d.tag != "" {
+		return fmt.Sprintf("consul service %v with tag %v", d.service, d.tag)
+	}
+	return fmt.Sprintf("consul service %v", d.service)
+}
+
+// run watches the service until ctx is cancelled
+func (d *consulDiscoverer) run(ctx context.Context, update func([]*zkServer)) {
+	var index uint64
+	updated := false
+	for {
+		q := (&consul.QueryOptions{WaitIndex: index, WaitTime: consulSDWaitTime}).WithContext(ctx)
+		services, meta, err := d.catalog.Service(d.service, d.tag, q)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("failed to discover %v: %v", d, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(d.retry):
+			}
+			continue
+		}
+
+		if updated && meta.LastIndex == index {
+			// the wait timed out without changes
+			continue
+		}
+		if meta.LastIndex < index {
+			// the index can go backwards, e.g. after consul restored a snapshot; blocking on it would never return
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+		if index < 1 {
+			// a wait index of 0 doesn't block, so we'd be hammering consul in a loop
+			index = 1
+		}
+
+		servers := d.servers(services)
+		log.Infof("discovered %d zookeeper servers from %v", len(servers), d)
+		update(servers)
+		updated = true
+	}
+}
+
+// servers converts the instances of the service into zkServers, sorted by ensemble and address
+func (d *consulDiscoverer) servers(services []*consul.CatalogService) []*zkServer {
+	seen := make(map[string]bool)
+	var servers []*zkServer
+	for _, s := range services {
+		// the service address, if it's registered with one, is more specific than its node's
+		addr := s.ServiceAddress
+		if addr == "" {
+			addr = s.Address
+		}
+		ipPort := net.JoinHostPort(addr, strconv.Itoa(s.ServicePort))
+		if seen[ipPort] {
+			log.Debugf("skipping %v: instance %v has the same address as another one", ipPort, s.ServiceID)
+			continue
+		}
+		seen[ipPort] = true
+
+		zk := newZKServer(ipPort)
+		zk.ensemble = s.ServiceMeta[d.ensembleMeta]
+		if zk.ensemble == "" {
+			zk.ensemble = *ensembleName
+		}
+		zk.labels = make([]string, len(d.metaKeys))
+		for i, key := range d.metaKeys {
+			zk.labels[i] = s.ServiceMeta[key]
+		}
+		servers = append(servers, zk)
+	}
+
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].ensemble != servers[j].ensemble {
+			return servers[i].ensemble < servers[j].ensemble
+		}
+		return servers[i].ipPort < servers[j].ipPort
+	})
+	return servers
+}
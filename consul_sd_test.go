@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	consul "github.com/hashicorp/consul/api"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCatalog is an httptest stand-in for consul's catalog API, answering blocking queries for one service
+type fakeCatalog struct {
+	*httptest.Server
+	mu       sync.Mutex
+	index    uint64
+	services []*consul.CatalogService
+	changed  chan struct{}
+	tags     []string
+}
+
+func newFakeCatalog(services ...*consul.CatalogService) *fakeCatalog {
+	c := &fakeCatalog{index: 1, services: services, changed: make(chan struct{})}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/catalog/service/zookeeper" {
+			http.NotFound(rw, req)
+			return
+		}
+		wait, _ := strconv.ParseUint(req.URL.Query().Get("index"), 10, 64)
+
+		c.mu.Lock()
+		c.tags = append(c.tags, req.URL.Query().Get("tag"))
+		// like consul, only block if there is an index to wait on
+		for wait > 0 && c.index <= wait {
+			changed := c.changed
+			c.mu.Unlock()
+			select {
+			case <-changed:
+			case <-req.Context().Done():
+				return
+			}
+			c.mu.Lock()
+		}
+		defer c.mu.Unlock()
+		rw.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+		_ = json.NewEncoder(rw).Encode(c.services)
+	}))
+	return c
+}
+
+func (c *fakeCatalog) set(services ...*consul.CatalogService) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index++
+	c.services = services
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeCatalog) discoverer(t *testing.T, metaKeys ...string) *consulDiscoverer {
+	consulConfig := consul.DefaultConfig()
+	consulConfig.Address = strings.TrimPrefix(c.URL, "http://")
+	consulClient, err := consul.NewClient(consulConfig)
+	assert.NilError(t, err)
+	return &consulDiscoverer{
+		catalog:      consulClient.Catalog(),
+		service:      "zookeeper",
+		tag:          "prod",
+		ensembleMeta: "ensemble",
+		metaKeys:     metaKeys,
+		retry:        10 * time.Millisecond,
+	}
+}
+
+func zkInstance(node, addr string, port int, meta map[string]string) *consul.CatalogService {
+	return &consul.CatalogService{Node: node, Address: addr, ServiceID: "zookeeper", ServicePort: port, ServiceMeta: meta}
+}
+
+func TestConsulDiscovery(t *testing.T) {
+	zk1 := zkInstance("zk1", "10.0.0.1", 2181, map[string]string{"ensemble": "a", "data-center": "ams"})
+	zk2 := zkInstance("zk2", "10.0.0.2", 2181, map[string]string{"ensemble": "a"})
+	zk3 := zkInstance("zk3", "10.0.0.3", 2181, nil)
+	zk3.ServiceAddress = "10.0.1.3"
+
+	*ensembleName = "default"
+	defer func() { *ensembleName = "" }()
+	catalog := newFakeCatalog(zk2, zk1)
+	defer catalog.Close()
+
+	updates := make(chan []*zkServer)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		catalog.discoverer(t, "data-center").run(ctx, func(servers []*zkServer) { updates <- servers })
+	}()
+
+	type target struct {
+		IPPort, Ensemble string
+		Labels           []string
+	}
+	targets := func(servers []*zkServer) []target {
+		var got []target
+		for _, zk := range servers {
+			got = append(got, target{zk.ipPort, zk.ensemble, zk.labels})
+		}
+		return got
+	}
+
+	assert.DeepEqual(t, targets(<-updates), []target{
+		{"10.0.0.1:2181", "a", []string{"ams"}},
+		{"10.0.0.2:2181", "a", []string{""}},
+	})
+
+	// zk1 leaves, zk3 joins with a service address and no ensemble
+	catalog.set(zk2, zk3)
+	assert.DeepEqual(t, targets(<-updates), []target{
+		{"10.0.0.2:2181", "a", []string{""}},
+		{"10.0.1.3:2181", "default", []string{""}},
+	})
+
+	cancel()
+	<-done
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+	assert.Equal(t, catalog.tags[0], "prod")
+}
+
+func TestConsulDiscoveryIndexZero(t *testing.T) {
+	catalog := newFakeCatalog(zkInstance("zk1", "10.0.0.1", 2181, nil))
+	defer catalog.Close()
+	catalog.index = 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	updates := 0
+	catalog.discoverer(t).run(ctx, func([]*zkServer) { updates++ })
+
+	// the first query, then one blocking until the timeout
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+	assert.Equal(t, len(catalog.tags), 2)
+	assert.Equal(t, updates, 1)
+}
+
+func TestConsulDiscovererSetup(t *testing.T) {
+	defer func() {
+		*consulSDService, *consulSDMetaLabels, targetLabelNames = "", "", nil
+	}()
+	*consulSDService = "zookeeper"
+
+	t.Run("meta labels", func(t *testing.T) {
+		*consulSDMetaLabels = "env, data-center"
+		d, err := newConsulDiscoverer()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, targetLabelNames, []string{"data_center", "env"})
+		assert.DeepEqual(t, d.metaKeys, []string{"data-center", "env"})
+	})
+
+	for _, tc := range []struct {
+		labels string
+		err    string
+	}{
+		{"ensemble", `label "ensemble" is used by the exporter itself`},
+		{"data-center,data_center", `"data-center" and "data_center" are both label "data_center"`},
+		{"1dc", `"1dc" is not a valid label name`},
+	} {
+		t.Run(tc.labels, func(t *testing.T) {
+			*consulSDMetaLabels = tc.labels
+			_, err := newConsulDiscoverer()
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -135,3 +136,68 @@ func TestConsulRegistration(t *testing.T) {
 		}
 	})
 }
+
+// fakeConsul is an httptest stand-in for the consul agent API, recording the requests it gets
+type fakeConsul struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string
+	// status to answer deregistrations with
+	deregisterStatus int
+}
+
+func newFakeConsul() *fakeConsul {
+	c := &fakeConsul{deregisterStatus: http.StatusOK}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.requests = append(c.requests, req.Method+" "+req.URL.Path)
+		if strings.HasPrefix(req.URL.Path, "/v1/agent/service/deregister/") && c.deregisterStatus != http.StatusOK {
+			http.Error(rw, "no", c.deregisterStatus)
+		}
+	}))
+	return c
+}
+
+func (c *fakeConsul) received() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.requests...)
+}
+
+// registrar returns a registered ServiceRegistrar talking to c, sending heartbeats
+func (c *fakeConsul) registrar(t *testing.T, name string) *ServiceRegistrar {
+	consulConfig := consul.DefaultConfig()
+	consulConfig.Address = strings.TrimPrefix(c.URL, "http://")
+	consulClient, err := consul.NewClient(consulConfig)
+	assert.NilError(t, err)
+
+	sr := &ServiceRegistrar{Name: name, Addr: "127.0.0.1:9898", TTLSeconds: 60, ConsulAgent: consulClient.Agent()}
+	assert.NilError(t, sr.RegisterService())
+	sr.heartbeat = startRunner(sr.updateCheckTTLForever)
+	return sr
+}
+
+func TestConsulDeregistration(t *testing.T) {
+	t.Run("deregisters by service ID", func(t *testing.T) {
+		c := newFakeConsul()
+		defer c.Close()
+
+		sr := c.registrar(t, "test-service")
+		assert.NilError(t, sr.deRegister())
+		assert.Assert(t, sr.heartbeat == nil, "heartbeats should be stopped")
+		assert.DeepEqual(t, c.received(), []string{
+			"PUT /v1/agent/service/register",
+			"PUT /v1/agent/service/deregister/test-service",
+		})
+	})
+
+	t.Run("consul error", func(t *testing.T) {
+		c := newFakeConsul()
+		defer c.Close()
+		c.deregisterStatus = http.StatusInternalServerError
+
+		sr := c.registrar(t, "test-service")
+		assert.ErrorContains(t, sr.deRegister(), "500")
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ZooKeeper's on disk formats, as found in dataDir/version-2: snapshot.<zxid> files holding the whole tree, and
+// log.<zxid> files holding the transactions since. Both start with a FileHeader: a magic number, a format version and
+// a database id.
+const (
+	snapshotMagic int32 = 0x5a4b534e // "ZKSN"
+	txnLogMagic   int32 = 0x5a4b4c47 // "ZKLG"
+
+	// every transaction in a log is followed by an end of record marker
+	txnEndOfRecord byte = 'B'
+)
+
+// names of the transaction types found in txnlogs
+var txnTypeNames = map[int32]string{
+	-11: "closeSession",
+	-10: "createSession",
+	-1:  "error",
+	1:   "create",
+	2:   "delete",
+	5:   "setData",
+	7:   "setACL",
+	13:  "check",
+	14:  "multi",
+	15:  "create2",
+	16:  "reconfig",
+	19:  "createContainer",
+	20:  "deleteContainer",
+	21:  "createTTL",
+}
+
+// transaction types whose record starts with the path they apply to
+var txnTypesWithPath = map[int32]bool{1: true, 2: true, 5: true, 7: true, 15: true, 19: true, 20: true, 21: true}
+
+func txnTypeName(t int32) string {
+	if name, ok := txnTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type%d", t)
+}
+
+// snapshotZnode is one znode of a snapshot
+type snapshotZnode struct {
+	path           string
+	dataLength     int
+	ephemeralOwner int64
+}
+
+// snapshot is what we read from a snapshot file. The checksum and (in 3.6+) digest at the end aren't read
+type snapshot struct {
+	sessions int
+	znodes   []snapshotZnode
+}
+
+// txnLogEntry is the header of one transaction of a txnlog, plus its path if it has one
+type txnLogEntry struct {
+	zxid    int64
+	time    int64
+	txnType int32
+	path    string
+}
+
+// readDataFile reads a snapshot or txnlog file, uncompressing it first if it has a .gz suffix
+func readDataFile(name string) ([]byte, error) {
+	byts, err := ioutil.ReadFile(name)
+	if err != nil || !strings.HasSuffix(name, ".gz") {
+		return byts, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(byts))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
+
+// readFileHeader checks the magic number of a snapshot or txnlog
+func readFileHeader(r *juteReader, magic int32) error {
+	got := r.readInt32()
+	r.readInt32() // version
+	r.readInt64() // dbid
+	if r.err != nil {
+		return r.err
+	}
+	if got != magic {
+		return fmt.Errorf("bad magic number %#x, expected %#x", got, magic)
+	}
+	return nil
+}
+
+// parseSnapshot decodes a snapshot: the sessions, the ACL cache, then every znode depth first, the root having an empty
+// path, until the "/" end marker
+func parseSnapshot(byts []byte) (*snapshot, error) {
+	r := newJuteReader(byts)
+	if err := readFileHeader(r, snapshotMagic); err != nil {
+		return nil, err
+	}
+
+	snap := &snapshot{sessions: int(r.readInt32())}
+	for i := 0; i < snap.sessions && r.err == nil; i++ {
+		r.readInt64() // session id
+		r.readInt32() // timeout
+	}
+
+	// ACL cache: a map of id -> ACL vector
+	for acls := r.readInt32(); acls > 0 && r.err == nil; acls-- {
+		r.readInt64()
+		for n := r.readInt32(); n > 0 && r.err == nil; n-- {
+			r.readInt32()  // perms
+			r.readString() // scheme
+			r.readString() // id
+		}
+	}
+
+	for r.err == nil {
+		path := r.readString()
+		if path == "/" {
+			break
+		}
+		data := r.readBuffer()
+		r.readInt64() // acl
+		// StatPersisted
+		r.readInt64() // czxid
+		r.readInt64() // mzxid
+		r.readInt64() // ctime
+		r.readInt64() // mtime
+		r.readInt32() // version
+		r.readInt32() // cversion
+		r.readInt32() // aversion
+		ephemeralOwner := r.readInt64()
+		r.readInt64() // pzxid
+
+		if path == "" {
+			path = "/"
+		}
+		snap.znodes = append(snap.znodes, snapshotZnode{path: path, dataLength: len(data), ephemeralOwner: ephemeralOwner})
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot after %d znodes: %v", len(snap.znodes), r.err)
+	}
+	return snap, nil
+}
+
+// parseTxnLog decodes a txnlog: after the header, each transaction is a checksum, the serialised transaction as a
+// buffer, and an end of record marker. Logs are preallocated and zero filled, so an empty transaction marks the end.
+func parseTxnLog(byts []byte) ([]txnLogEntry, error) {
+	r := newJuteReader(byts)
+	if err := readFileHeader(r, txnLogMagic); err != nil {
+		return nil, err
+	}
+
+	var entries []txnLogEntry
+	for r.remaining() > 0 {
+		r.readInt64() // checksum
+		txn := r.readBuffer()
+		if r.err != nil || len(txn) == 0 {
+			// a transaction cut short by a crash is as much as ZK itself would read
+			break
+		}
+		if eor := r.next(1); eor == nil || eor[0] != txnEndOfRecord {
+			return entries, fmt.Errorf("missing end of record marker after zxid %#x", lastZxid(entries))
+		}
+
+		t := newJuteReader(txn)
+		t.readInt64() // client id
+		t.readInt32() // cxid
+		entry := txnLogEntry{zxid: t.readInt64(), time: t.readInt64(), txnType: t.readInt32()}
+		if txnTypesWithPath[entry.txnType] {
+			entry.path = t.readString()
+		}
+		if t.err != nil {
+			return entries, fmt.Errorf("failed to decode transaction after zxid %#x: %v", lastZxid(entries), t.err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func lastZxid(entries []txnLogEntry) int64 {
+	if len(entries) == 0 {
+		return 0
+	}
+	return entries[len(entries)-1].zxid
+}
+
+// dataFile is a snapshot or txnlog file, named after the first zxid it holds
+type dataFile struct {
+	name string
+	zxid int64
+}
+
+// findDataFiles returns the files in dir starting with prefix (e.g. "snapshot."), oldest first
+func findDataFiles(dir, prefix string) ([]dataFile, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []dataFile
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasPrefix(info.Name(), prefix) {
+			continue
+		}
+		hex := strings.TrimSuffix(strings.TrimPrefix(info.Name(), prefix), ".gz")
+		zxid, err := strconv.ParseInt(hex, 16, 64)
+		if err != nil {
+			log.Debugf("skipping %v: not named after a zxid", info.Name())
+			continue
+		}
+		files = append(files, dataFile{name: filepath.Join(dir, info.Name()), zxid: zxid})
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].zxid < files[j].zxid })
+	return files, nil
+}
+
+// versionDir returns dir/version-2 if it exists, dir otherwise, so either the dataDir or its version-2 subdirectory
+// can be given
+func versionDir(dir string) string {
+	versioned := filepath.Join(dir, "version-2")
+	if info, err := os.Stat(versioned); err == nil && info.IsDir() {
+		return versioned
+	}
+	return dir
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// dns+host:port: one target per A/AAAA record of host
+	dnsPrefix = "dns+"
+	// dnssrv+name: one target per SRV record of name
+	dnsSRVPrefix = "dnssrv+"
+
+	dnsResolveTimeout = 10 * time.Second
+)
+
+// dnsResolver is the part of net.Resolver we use, so tests can fake it
+type dnsResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+var resolver dnsResolver = net.DefaultResolver
+
+// isDNSTarget tells targets that are re-resolved every --zk.dns-refresh-interval apart from static ones
+func isDNSTarget(target string) bool {
+	return strings.HasPrefix(target, dnsPrefix) || strings.HasPrefix(target, dnsSRVPrefix)
+}
+
+// checkDNSTarget validates a dns+ or dnssrv+ target
+func checkDNSTarget(target string) error {
+	if strings.HasPrefix(target, dnsSRVPrefix) {
+		if strings.TrimPrefix(target, dnsSRVPrefix) == "" {
+			return fmt.Errorf("%q has no name to look up", target)
+		}
+		return nil
+	}
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(target, dnsPrefix))
+	if err != nil || host == "" || port == "" {
+		return fmt.Errorf("%q is not dns+host:port", target)
+	}
+	return nil
+}
+
+// resolveDNSTarget expands a dns+ or dnssrv+ target into a server per address it resolves to. The address is only
+// used to connect: each server's zk_instance is the hostname behind the address, so it stays the same when e.g. a pod
+// is rescheduled and comes back with a different IP. For SRV records that's the record's target, for A records the
+// name the address points back to, or the address itself if there is no PTR record.
+func resolveDNSTarget(ctx context.Context, target *zkServer) ([]*zkServer, error) {
+	type address struct{ host, addr string }
+	var addrs []address
+
+	if strings.HasPrefix(target.ipPort, dnsSRVPrefix) {
+		_, records, err := resolver.LookupSRV(ctx, "", "", strings.TrimPrefix(target.ipPort, dnsSRVPrefix))
+		if err != nil {
+			return nil, err
+		}
+		var lookupErr error
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			ips, err := resolver.LookupHost(ctx, host)
+			if err != nil {
+				// a member that was just rescheduled may not resolve yet; that's no reason to stop polling the others
+				log.Warnf("failed to resolve %v from %v: %v", host, target.ipPort, err)
+				lookupErr = err
+				continue
+			}
+			if len(ips) == 0 {
+				continue
+			}
+			sort.Strings(ips)
+			port := strconv.Itoa(int(srv.Port))
+			addrs = append(addrs, address{net.JoinHostPort(host, port), net.JoinHostPort(ips[0], port)})
+		}
+		if len(addrs) == 0 && lookupErr != nil {
+			return nil, lookupErr
+		}
+	} else {
+		host, port, err := net.SplitHostPort(strings.TrimPrefix(target.ipPort, dnsPrefix))
+		if err != nil {
+			return nil, err
+		}
+		ips, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			name := ip
+			if names, err := resolver.LookupAddr(ctx, ip); err == nil && len(names) > 0 {
+				sort.Strings(names)
+				name = strings.TrimSuffix(names[0], ".")
+			}
+			addrs = append(addrs, address{net.JoinHostPort(name, port), net.JoinHostPort(ip, port)})
+		}
+	}
+
+	var servers []*zkServer
+	for _, a := range addrs {
+		zk := newZKServer(a.host)
+		zk.targetSettings = target.targetSettings
+		zk.addr = a.addr
+		zk.dnsTarget = target.ipPort
+		zk.tlsConfig, zk.httpClient = target.tlsConfig, target.httpClient
+		if zk.tlsConfig != nil && zk.tlsConfig.ServerName == "" {
+			// verify the certificate against the hostname, rather than the address we connect to
+			zk.tlsConfig = zk.tlsConfig.Clone()
+			zk.tlsConfig.ServerName, _, _ = net.SplitHostPort(a.host)
+		}
+		servers = append(servers, zk)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ipPort < servers[j].ipPort })
+	return servers, nil
+}
+
+// resolveTargets replaces the DNS targets among servers by what they resolve to. A target that fails to resolve keeps
+// the servers it resolved to in previous, if any, so a DNS hiccup doesn't stop polling.
+func resolveTargets(ctx context.Context, servers, previous []*zkServer) []*zkServer {
+	var resolved []*zkServer
+	seen := make(map[string]bool)
+	add := func(zk *zkServer) {
+		if seen[zk.ipPort] {
+			log.Debugf("[%v] skipping duplicate target, from %v", zk.ipPort, zk.dnsTarget)
+			return
+		}
+		seen[zk.ipPort] = true
+		resolved = append(resolved, zk)
+	}
+
+	for _, zk := range servers {
+		if !isDNSTarget(zk.ipPort) {
+			add(zk)
+			continue
+		}
+
+		expanded, err := resolveDNSTarget(ctx, zk)
+		if err != nil {
+			log.Errorf("[%v] failed to resolve, keeping the last addresses: %v", zk.ipPort, err)
+			for _, prev := range previous {
+				if prev.dnsTarget == zk.ipPort {
+					add(prev)
+				}
+			}
+			continue
+		}
+		if len(expanded) == 0 {
+			log.Warnf("[%v] resolved to no addresses", zk.ipPort)
+		}
+		for _, e := range expanded {
+			add(e)
+		}
+	}
+	return resolved
+}
+
+func hasDNSTargets(servers []*zkServer) bool {
+	for _, zk := range servers {
+		if isDNSTarget(zk.ipPort) {
+			return true
+		}
+	}
+	return false
+}
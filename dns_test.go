@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"gotest.tools/assert"
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeResolver answers lookups from its maps, and fails those it has no answer for
+type fakeResolver struct {
+	mu    sync.Mutex
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+	addrs map[string][]string
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	records, ok := r.srv[name]
+	if !ok {
+		return "", nil, errors.New("no such host")
+	}
+	return name, records, nil
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return ips, nil
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names, ok := r.addrs[addr]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return names, nil
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_client._tcp.zk.ns.svc": {
+				{Target: "zk-1.zk.ns.svc.", Port: 2181},
+				{Target: "zk-0.zk.ns.svc.", Port: 2181},
+			},
+		},
+		hosts: map[string][]string{
+			"zk-0.zk.ns.svc": {"10.0.0.10"},
+			"zk-1.zk.ns.svc": {"10.0.0.11"},
+			"zk-headless":    {"10.0.0.10", "10.0.0.12"},
+		},
+		addrs: map[string][]string{
+			"10.0.0.10": {"zk-0.zk.ns.svc."},
+		},
+	}
+}
+
+// instance -> address of the servers
+func addresses(servers []*zkServer) map[string]string {
+	addrs := make(map[string]string)
+	for _, zk := range servers {
+		addrs[zk.ipPort] = zk.addr
+	}
+	return addrs
+}
+
+func TestResolveTargets(t *testing.T) {
+	defer func(prev dnsResolver) { resolver = prev }(resolver)
+	r := newFakeResolver()
+	resolver = r
+
+	srv, a, static := newZKServer("dnssrv+_client._tcp.zk.ns.svc"), newZKServer("dns+zk-headless:2181"), newZKServer("10.0.0.1:2181")
+	srv.ensemble = "prod"
+	servers := resolveTargets(context.Background(), []*zkServer{srv, a, static}, nil)
+
+	assert.DeepEqual(t, addresses(servers), map[string]string{
+		"zk-0.zk.ns.svc:2181": "10.0.0.10:2181",
+		"zk-1.zk.ns.svc:2181": "10.0.0.11:2181",
+		// zk-0 again, through the A record, is skipped; 10.0.0.12 has no PTR record
+		"10.0.0.12:2181": "10.0.0.12:2181",
+		"10.0.0.1:2181":  "",
+	})
+	assert.Equal(t, servers[0].ipPort, "zk-0.zk.ns.svc:2181")
+	assert.Equal(t, servers[0].ensemble, "prod")
+	assert.Equal(t, servers[0].dnsTarget, "dnssrv+_client._tcp.zk.ns.svc")
+
+	t.Run("failed lookups keep the last addresses", func(t *testing.T) {
+		r.mu.Lock()
+		delete(r.srv, "_client._tcp.zk.ns.svc")
+		r.hosts["zk-headless"] = []string{"10.0.0.13"}
+		r.mu.Unlock()
+
+		again := resolveTargets(context.Background(), []*zkServer{srv, a, static}, servers)
+		assert.DeepEqual(t, addresses(again), map[string]string{
+			"zk-0.zk.ns.svc:2181": "10.0.0.10:2181",
+			"zk-1.zk.ns.svc:2181": "10.0.0.11:2181",
+			"10.0.0.13:2181":      "10.0.0.13:2181",
+			"10.0.0.1:2181":       "",
+		})
+		assert.Assert(t, again[0] == servers[0])
+	})
+
+	t.Run("SRV records that fail to resolve are skipped", func(t *testing.T) {
+		r.mu.Lock()
+		r.srv["_client._tcp.zk.ns.svc"] = []*net.SRV{
+			{Target: "zk-0.zk.ns.svc.", Port: 2181},
+			{Target: "zk-2.zk.ns.svc.", Port: 2181},
+		}
+		r.mu.Unlock()
+
+		again := resolveTargets(context.Background(), []*zkServer{srv}, servers)
+		assert.DeepEqual(t, addresses(again), map[string]string{
+			"zk-0.zk.ns.svc:2181": "10.0.0.10:2181",
+		})
+
+		// unless none resolve, which keeps the last addresses like a failed SRV lookup
+		r.mu.Lock()
+		r.srv["_client._tcp.zk.ns.svc"] = []*net.SRV{{Target: "zk-2.zk.ns.svc.", Port: 2181}}
+		r.mu.Unlock()
+
+		again = resolveTargets(context.Background(), []*zkServer{srv}, servers)
+		assert.Equal(t, len(again), 2)
+	})
+}
+
+func TestTargetManagerDNS(t *testing.T) {
+	defer func(prev dnsResolver) { resolver = prev }(resolver)
+	r := newFakeResolver()
+	resolver = r
+
+	tm := newTargetManager(nil)
+	tm.apply([]*zkServer{newZKServer("dnssrv+_client._tcp.zk.ns.svc")})
+	defer tm.stopAll()
+	before := tm.current()
+	assert.Equal(t, len(before), 2)
+
+	// zk-1 is rescheduled and comes back with a new IP: same instance, new address
+	r.mu.Lock()
+	r.hosts["zk-1.zk.ns.svc"] = []string{"10.0.0.21"}
+	r.mu.Unlock()
+
+	tm.resolveAgain(context.Background())
+	after := tm.current()
+
+	assert.Assert(t, after[0] == before[0], "unchanged zk-0 should be kept")
+	assert.Equal(t, after[1].ipPort, "zk-1.zk.ns.svc:2181")
+	assert.Equal(t, after[1].addr, "10.0.0.21:2181")
+}
+
+// slowResolver is a fakeResolver whose SRV lookups wait until released
+type slowResolver struct {
+	*fakeResolver
+	started, release chan struct{}
+}
+
+func (r *slowResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	close(r.started)
+	<-r.release
+	return r.fakeResolver.LookupSRV(ctx, service, proto, name)
+}
+
+func TestTargetManagerOverlappingApplies(t *testing.T) {
+	defer func(prev dnsResolver) { resolver = prev }(resolver)
+	r := &slowResolver{fakeResolver: newFakeResolver(), started: make(chan struct{}), release: make(chan struct{})}
+	resolver = r
+
+	tm := newTargetManager(nil)
+	defer tm.stopAll()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tm.apply([]*zkServer{newZKServer("dnssrv+_client._tcp.zk.ns.svc")})
+	}()
+
+	// a reload comes in while the first one is still resolving, and wins even though it's done first
+	<-r.started
+	tm.apply([]*zkServer{newZKServer("10.0.0.1:2181")})
+	close(r.release)
+	<-done
+
+	assert.DeepEqual(t, addresses(tm.current()), map[string]string{"10.0.0.1:2181": ""})
+}
+
+func TestCheckDNSTarget(t *testing.T) {
+	assert.NilError(t, checkDNSTarget("dnssrv+_client._tcp.zk.ns.svc"))
+	assert.NilError(t, checkDNSTarget("dns+zk-headless:2181"))
+	assert.ErrorContains(t, checkDNSTarget("dns+zk-headless"), "is not dns+host:port")
+	assert.ErrorContains(t, checkDNSTarget("dnssrv+"), "has no name")
+}
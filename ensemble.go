@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	ensembleMembers     = "ensemble_members"
+	ensembleMembersUp   = "ensemble_members_up"
+	ensembleLeaderCount = "ensemble_leader_count"
+	ensembleQuorumOK    = "ensemble_quorum_ok"
+	ensembleZxidSpread  = "ensemble_zxid_spread"
+	ensembleSplitBrain  = "ensemble_split_brain"
+)
+
+var ensembleLabels = exporterLabels("ensemble")
+
+// descriptors of the metrics derived from all members of an ensemble
+type ensembleDescs struct {
+	members     *prometheus.Desc
+	membersUp   *prometheus.Desc
+	leaderCount *prometheus.Desc
+	quorumOK    *prometheus.Desc
+	zxidSpread  *prometheus.Desc
+	splitBrain  *prometheus.Desc
+
+	canarySuccess *prometheus.Desc
+	canaryCommit  *prometheus.Desc
+}
+
+func newEnsembleDescs() ensembleDescs {
+	newDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prependNamespace(name), help, append(append([]string(nil), ensembleLabels...), targetLabelNames...), nil)
+	}
+
+	return ensembleDescs{
+		members:     newDesc(ensembleMembers, "Number of configured members of the ensemble"),
+		membersUp:   newDesc(ensembleMembersUp, "Number of ensemble members that answered the last poll"),
+		leaderCount: newDesc(ensembleLeaderCount, "Number of ensemble members claiming to be the leader (or standalone)"),
+		quorumOK:    newDesc(ensembleQuorumOK, "1 if the ensemble has exactly one leader with a quorum of synced followers"),
+		zxidSpread:  newDesc(ensembleZxidSpread, "Difference between the highest and lowest zxid of the members that are up"),
+		splitBrain:  newDesc(ensembleSplitBrain, "1 if more than one member claims to be the leader"),
+
+		canarySuccess: newDesc(canarySuccess, "Whether the last canary znode was written and read back from every member"),
+		canaryCommit:  newDesc(canaryCommitSeconds, "How long the last canary write took to be committed in seconds"),
+	}
+}
+
+// ensembleHealth is what we work out about an ensemble from the latest state of its members
+type ensembleHealth struct {
+	members     int
+	membersUp   int
+	leaders     int
+	quorumOK    bool
+	zxidSpread  uint64
+	hasZxid     bool
+	splitBrain  bool
+	leaderState *instanceState
+}
+
+// computes the health of one ensemble from the state of its members
+func newEnsembleHealth(members []*instanceState) ensembleHealth {
+	h := ensembleHealth{members: len(members)}
+	var minZxid, maxZxid uint64
+
+	for _, state := range members {
+		if !state.up {
+			continue
+		}
+		h.membersUp++
+
+		if s, ok := state.samples[zkServerState]; ok {
+			if st := serverState(s.value); st == leader || st == standalone {
+				h.leaders++
+				h.leaderState = state
+			}
+		}
+
+		if state.hasZxid {
+			if !h.hasZxid || state.zxid < minZxid {
+				minZxid = state.zxid
+			}
+			if !h.hasZxid || state.zxid > maxZxid {
+				maxZxid = state.zxid
+			}
+			h.hasZxid = true
+		}
+	}
+
+	if h.hasZxid {
+		h.zxidSpread = maxZxid - minZxid
+	}
+	h.splitBrain = h.leaders > 1
+
+	// a quorum needs exactly one leader, which along with its synced followers makes up a majority of the ensemble.
+	// Servers that don't report synced followers (standalone, old versions) fall back to counting members that are up
+	if h.leaders == 1 {
+		quorumSize := h.membersUp
+		if s, ok := h.leaderState.samples[zkSyncedFollowers]; ok {
+			quorumSize = int(s.value) + 1
+		}
+		h.quorumOK = quorumSize > h.members/2
+	}
+	return h
+}
+
+// exports the derived ensemble metrics. Caller must hold m.mu
+func (m *zkMetrics) collectEnsembles(ch chan<- prometheus.Metric) {
+	ensembles := make(map[string][]*instanceState)
+	for _, state := range m.instances {
+		// instances we only know from probes don't belong to an ensemble
+		if state.ensemble == "" {
+			continue
+		}
+		ensembles[state.ensemble] = append(ensembles[state.ensemble], state)
+	}
+
+	boolToFloat := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	d := m.ensembleDescs
+	for name, members := range ensembles {
+		h := newEnsembleHealth(members)
+		// members of an ensemble share its labels, so any member's will do
+		labels := members[0].metricLabels(name)
+
+		ch <- prometheus.MustNewConstMetric(d.members, prometheus.GaugeValue, float64(h.members), labels...)
+		ch <- prometheus.MustNewConstMetric(d.membersUp, prometheus.GaugeValue, float64(h.membersUp), labels...)
+		ch <- prometheus.MustNewConstMetric(d.leaderCount, prometheus.GaugeValue, float64(h.leaders), labels...)
+		ch <- prometheus.MustNewConstMetric(d.quorumOK, prometheus.GaugeValue, boolToFloat(h.quorumOK), labels...)
+		ch <- prometheus.MustNewConstMetric(d.splitBrain, prometheus.GaugeValue, boolToFloat(h.splitBrain), labels...)
+		if h.hasZxid {
+			ch <- prometheus.MustNewConstMetric(d.zxidSpread, prometheus.GaugeValue, float64(h.zxidSpread), labels...)
+		}
+
+		if c, ok := m.canaries[name]; ok {
+			ch <- prometheus.MustNewConstMetric(d.canarySuccess, prometheus.GaugeValue, boolToFloat(c.success), labels...)
+			if c.written {
+				ch <- prometheus.MustNewConstMetric(d.canaryCommit, prometheus.GaugeValue, c.commit.Seconds(), labels...)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"gotest.tools/assert"
+	"testing"
+)
+
+// builds the member states of an ensemble from the stats each member returned; nil stats means the poll failed
+func ensembleMembersFrom(t *testing.T, stats map[string]map[string]string) []*instanceState {
+	m := newMetrics()
+	for instance, s := range stats {
+		m.addInstance(instance, "test")
+		var err error
+		if s == nil {
+			err = errors.New("connection refused")
+		}
+		m.refresh(instance, s, err)
+	}
+
+	var members []*instanceState
+	for _, state := range m.instances {
+		members = append(members, state)
+	}
+	return members
+}
+
+func TestEnsembleHealth(t *testing.T) {
+	t.Run("healthy ensemble", func(t *testing.T) {
+		h := newEnsembleHealth(ensembleMembersFrom(t, map[string]map[string]string{
+			"zk1:2181": {zkServerState: "leader", zkSyncedFollowers: "2", zkZxid: "4294967306"},
+			"zk2:2181": {zkServerState: "follower", zkZxid: "4294967305"},
+			"zk3:2181": {zkServerState: "follower", zkZxid: "4294967300"},
+		}))
+		assert.Equal(t, h.members, 3)
+		assert.Equal(t, h.membersUp, 3)
+		assert.Equal(t, h.leaders, 1)
+		assert.Assert(t, h.quorumOK)
+		assert.Assert(t, !h.splitBrain)
+		assert.Equal(t, h.zxidSpread, uint64(6))
+	})
+
+	t.Run("leader without synced quorum", func(t *testing.T) {
+		h := newEnsembleHealth(ensembleMembersFrom(t, map[string]map[string]string{
+			"zk1:2181": {zkServerState: "leader", zkSyncedFollowers: "0"},
+			"zk2:2181": nil,
+			"zk3:2181": nil,
+		}))
+		assert.Equal(t, h.membersUp, 1)
+		assert.Assert(t, !h.quorumOK)
+		assert.Assert(t, !h.hasZxid)
+	})
+
+	t.Run("split brain", func(t *testing.T) {
+		h := newEnsembleHealth(ensembleMembersFrom(t, map[string]map[string]string{
+			"zk1:2181": {zkServerState: "leader", zkSyncedFollowers: "1"},
+			"zk2:2181": {zkServerState: "leader", zkSyncedFollowers: "1"},
+			"zk3:2181": {zkServerState: "follower"},
+		}))
+		assert.Equal(t, h.leaders, 2)
+		assert.Assert(t, h.splitBrain)
+		assert.Assert(t, !h.quorumOK)
+	})
+
+	t.Run("standalone", func(t *testing.T) {
+		h := newEnsembleHealth(ensembleMembersFrom(t, map[string]map[string]string{
+			"zk1:2181": {zkServerState: "standalone"},
+		}))
+		assert.Assert(t, h.quorumOK)
+	})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	isroCMD = "isro"
+
+	// version the fake claims to be
+	fakeZKVersion = "3.6.3--6401e4ad2087061bc6b9f80dec2d69f2e3c8660a, built on 04/08/2021 16:35 GMT"
+)
+
+// server states the fake can be in, as reported by mntr and srvr
+var fakeZKModes = []string{"leader", "follower", "standalone", "observer"}
+
+// fakeZK is an in-process ZooKeeper that speaks the four letter word protocol: mntr, ruok, srvr, envi, conf, cons and
+// isro. It can be told to answer as a leader, follower or standalone server, to not serve requests, to answer slowly
+// or to reset connections, and any command's response can be scripted. Used by the tests and the fake-zk command.
+type fakeZK struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+	done     chan struct{}
+
+	mu         sync.Mutex
+	mode       string
+	notServing bool
+	readOnly   bool
+	delay      time.Duration
+	reset      bool
+	responses  map[string]string
+	// number of times each command was received
+	requests map[string]int
+	zxid     uint64
+}
+
+// newFakeZK starts a fake leader listening on addr, e.g. 127.0.0.1:0 for any free port
+func newFakeZK(addr string) (*fakeZK, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	f := &fakeZK{
+		listener:  l,
+		done:      make(chan struct{}),
+		mode:      "leader",
+		responses: make(map[string]string),
+		requests:  make(map[string]int),
+		zxid:      0x100000000,
+	}
+	f.wg.Add(1)
+	go f.serve()
+	return f, nil
+}
+
+func (f *fakeZK) addr() string {
+	return f.listener.Addr().String()
+}
+
+// close stops listening, and waits for the connections being answered, cutting any delay short
+func (f *fakeZK) close() error {
+	close(f.done)
+	err := f.listener.Close()
+	f.wg.Wait()
+	return err
+}
+
+// setMode makes the fake answer as a leader, follower, standalone server or observer
+func (f *fakeZK) setMode(mode string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mode = mode
+}
+
+// setServing false makes the fake answer like a server that lost its quorum
+func (f *fakeZK) setServing(serving bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.notServing = !serving
+}
+
+// setReadOnly makes isro answer ro
+func (f *fakeZK) setReadOnly(readOnly bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readOnly = readOnly
+}
+
+// setDelay makes the fake wait before answering
+func (f *fakeZK) setDelay(delay time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delay = delay
+}
+
+// setReset makes the fake reset connections instead of answering
+func (f *fakeZK) setReset(reset bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reset = reset
+}
+
+// setResponse makes the fake answer cmd with response, instead of the generated answer. An empty response goes back to
+// the generated one
+func (f *fakeZK) setResponse(cmd, response string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if response == "" {
+		delete(f.responses, cmd)
+		return
+	}
+	f.responses[cmd] = response
+}
+
+// requestCount returns the number of times cmd was received
+func (f *fakeZK) requestCount(cmd string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[cmd]
+}
+
+func (f *fakeZK) serve() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			f.handle(conn)
+		}()
+	}
+}
+
+// handle answers one command: like ZooKeeper, it reads the four letters, writes the answer and closes the connection
+func (f *fakeZK) handle(conn net.Conn) {
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	cmd := string(buf)
+
+	f.mu.Lock()
+	f.requests[cmd]++
+	delay, reset := f.delay, f.reset
+	response, ok := f.responses[cmd]
+	if !ok {
+		response = f.response(cmd)
+	}
+	f.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-f.done:
+			return
+		}
+	}
+	if reset {
+		// an RST rather than a FIN
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			_ = tcp.SetLinger(0)
+		}
+		return
+	}
+	if _, err := io.WriteString(conn, response); err != nil {
+		return
+	}
+
+	// closing with the client's newline still unread would reset the connection, so half close and wait for the
+	// client to close its end
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.CloseWrite()
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}
+}
+
+// response generates the answer to cmd, f.mu must be held. Unknown commands get no answer, as with ZooKeeper
+func (f *fakeZK) response(cmd string) string {
+	if f.notServing {
+		switch cmd {
+		case monitorCMD, srvrCMD, consCMD, confCMD:
+			return notServingRequests + "\n"
+		case isroCMD:
+			return "null"
+		}
+	}
+
+	received := 0
+	for _, n := range f.requests {
+		received += n
+	}
+	switch cmd {
+	case okCMD:
+		return "imok"
+	case isroCMD:
+		if f.readOnly {
+			return "ro"
+		}
+		return "rw"
+	case monitorCMD:
+		mntr := [][2]interface{}{
+			{"zk_version", fakeZKVersion},
+			{"zk_avg_latency", 0},
+			{"zk_max_latency", 12},
+			{"zk_min_latency", 0},
+			{"zk_packets_received", received},
+			{"zk_packets_sent", received - 1},
+			{"zk_num_alive_connections", 1},
+			{"zk_outstanding_requests", 0},
+			{"zk_server_state", f.mode},
+			{"zk_znode_count", 5},
+			{"zk_watch_count", 0},
+			{"zk_ephemerals_count", 0},
+			{"zk_approximate_data_size", 44},
+			{"zk_open_file_descriptor_count", 64},
+			{"zk_max_file_descriptor_count", 1048576},
+		}
+		if f.mode == "leader" {
+			mntr = append(mntr, [2]interface{}{"zk_followers", 2}, [2]interface{}{"zk_synced_followers", 2},
+				[2]interface{}{"zk_pending_syncs", 0})
+		}
+		var b strings.Builder
+		for _, kv := range mntr {
+			fmt.Fprintf(&b, "%v\t%v\n", kv[0], kv[1])
+		}
+		return b.String()
+	case srvrCMD:
+		return fmt.Sprintf("Zookeeper version: %v\nLatency min/avg/max: 0/0/12\nReceived: %d\nSent: %d\n"+
+			"Connections: 1\nOutstanding: 0\nZxid: %#x\nMode: %v\nNode count: 5\n",
+			fakeZKVersion, received, received-1, f.zxid, f.mode)
+	case enviCMD:
+		return "Environment:\nzookeeper.version=" + fakeZKVersion + "\nhost.name=fake-zk\njava.version=11.0.11\n" +
+			"java.vendor=Oracle Corporation\nos.name=Linux\nos.arch=amd64\n"
+	case confCMD:
+		return "clientPort=2181\ndataDir=/data/version-2\ndataLogDir=/datalog/version-2\ntickTime=2000\n" +
+			"maxClientCnxns=60\nserverId=1\ninitLimit=10\nsyncLimit=5\n"
+	case consCMD:
+		return fmt.Sprintf(" /127.0.0.1:50000[1](queued=0,recved=%d,sent=%d,sid=0x100000000000001,lop=PING,"+
+			"est=1617000000000,to=30000,lcxid=0x0,lzxid=%#x,lresp=1617000001000,llat=0,minlat=0,avglat=0,maxlat=2)\n\n",
+			received, received-1, f.zxid)
+	}
+	return ""
+}
+
+// runFakeZK is the fake-zk command: it serves until SIGINT or SIGTERM
+func runFakeZK() error {
+	f, err := newFakeZK(*fakeZKListenAddress)
+	if err != nil {
+		return err
+	}
+	f.setMode(*fakeZKMode)
+	f.setServing(!*fakeZKNotServing)
+	f.setReadOnly(*fakeZKReadOnly)
+	f.setDelay(time.Duration(*fakeZKDelay) * time.Millisecond)
+	log.Infof("fake %v listening on %v", *fakeZKMode, f.addr())
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	return f.close()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileSDGroup is a target group of a prometheus file_sd file
+type fileSDGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// fileSDVersion tells whether a file changed since we last read it
+type fileSDVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// fileDiscoverer reads the servers to poll from prometheus file_sd files, checking them for changes every interval.
+// A group's `ensemble` label names the ensemble of its targets, its other labels are added to their metrics.
+type fileDiscoverer struct {
+	patterns []string
+	interval time.Duration
+
+	// the last version of each file we read, and its groups; a file that fails to read keeps its last groups
+	versions map[string]fileSDVersion
+	groups   map[string][]fileSDGroup
+	// the label names we started with, nil while starting
+	known map[string]bool
+}
+
+// newFileDiscoverer reads the --file-sd.files, and sets targetLabelNames to the labels of all their groups, which must
+// be done before the metrics are created. Labels that show up later on need a restart.
+func newFileDiscoverer() (*fileDiscoverer, error) {
+	if *zkHostString != "" || *configFile != "" || *consulSDService != "" {
+		return nil, fmt.Errorf("--file-sd.files can't be used along with --zk.hosts, --config.file or --consul.sd.service")
+	}
+
+	if *fileSDRefreshInterval <= 0 {
+		return nil, fmt.Errorf("--file-sd.refresh-interval must be positive")
+	}
+
+	d := &fileDiscoverer{
+		interval: time.Duration(*fileSDRefreshInterval) * time.Second,
+		versions: make(map[string]fileSDVersion),
+		groups:   make(map[string][]fileSDGroup),
+	}
+	for _, pattern := range strings.Split(*fileSDFiles, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			d.patterns = append(d.patterns, pattern)
+		}
+	}
+	if _, err := d.refresh(); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	targetLabelNames = nil
+	for _, groups := range d.groups {
+		for _, g := range groups {
+			for name := range g.Labels {
+				if !seen[name] && name != "ensemble" {
+					seen[name] = true
+					targetLabelNames = append(targetLabelNames, name)
+				}
+			}
+		}
+	}
+	sort.Strings(targetLabelNames)
+	d.known = seen
+	return d, nil
+}
+
+func (d *fileDiscoverer) String() string {
+	return "file_sd " + strings.Join(d.patterns, ",")
+}
+
+// run hands over the servers read on startup, then checks the files for changes every interval until ctx is cancelled
+func (d *fileDiscoverer) run(ctx context.Context, update func([]*zkServer)) {
+	update(d.servers())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.interval):
+		}
+
+		changed, err := d.refresh()
+		if err != nil {
+			log.Errorf("failed to read %v: %v", d, err)
+		}
+		if changed {
+			servers := d.servers()
+			log.Infof("read %d zookeeper servers from %v", len(servers), d)
+			update(servers)
+		}
+	}
+}
+
+// refresh reads the files that are new or changed since the last refresh, and forgets those that are gone. Returns
+// whether anything changed. A file that fails to read or validate keeps its last groups, and is tried again next time
+func (d *fileDiscoverer) refresh() (bool, error) {
+	var names []string
+	for _, pattern := range d.patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return false, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		names = append(names, matches...)
+	}
+
+	changed := false
+	present := make(map[string]bool)
+	var errs []string
+	for _, name := range names {
+		present[name] = true
+		info, err := os.Stat(name)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		version := fileSDVersion{modTime: info.ModTime(), size: info.Size()}
+		if prev, ok := d.versions[name]; ok && prev == version {
+			continue
+		}
+
+		groups, err := readFileSD(name, d.known)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		d.versions[name], d.groups[name] = version, groups
+		changed = true
+	}
+
+	for name := range d.groups {
+		if !present[name] {
+			delete(d.versions, name)
+			delete(d.groups, name)
+			changed = true
+		}
+	}
+
+	if len(errs) > 0 {
+		return changed, fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return changed, nil
+}
+
+// readFileSD reads and validates a file_sd file, as JSON or YAML depending on its extension. If known isn't nil, labels
+// not in it are an error
+func readFileSD(name string, known map[string]bool) ([]fileSDGroup, error) {
+	byts, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []fileSDGroup
+	switch filepath.Ext(name) {
+	case ".json":
+		err = json.Unmarshal(byts, &groups)
+	case ".yml", ".yaml":
+		err = yaml.UnmarshalStrict(byts, &groups)
+	default:
+		return nil, fmt.Errorf("%v: file_sd files must end in .json, .yml or .yaml", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", name, err)
+	}
+
+	reserved := reservedLabels()
+	for i, g := range groups {
+		for _, target := range g.Targets {
+			if err := checkTarget(target); err != nil {
+				return nil, fmt.Errorf("%v: group #%d: target %v", name, i+1, err)
+			}
+		}
+		for label := range g.Labels {
+			switch {
+			case label == "ensemble":
+			case strings.HasPrefix(label, "__"):
+				// meta labels like __scheme__ or __metrics_path__, meant for prometheus; it drops them after
+				// relabeling, and so do we
+				delete(g.Labels, label)
+			case !labelNameRE.MatchString(label):
+				return nil, fmt.Errorf("%v: group #%d: %q is not a valid label name", name, i+1, label)
+			case reserved[label]:
+				return nil, fmt.Errorf("%v: group #%d: label %q is used by the exporter itself", name, i+1, label)
+			case known != nil && !known[label]:
+				return nil, fmt.Errorf("%v: group #%d: new label %q needs a restart", name, i+1, label)
+			}
+		}
+	}
+	return groups, nil
+}
+
+// servers builds a zkServer for every target of every group, in file order. A target listed more than once is polled
+// with the labels of its first group
+func (d *fileDiscoverer) servers() []*zkServer {
+	var names []string
+	for name := range d.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	seen := make(map[string]bool)
+	var servers []*zkServer
+	for _, name := range names {
+		for _, g := range d.groups[name] {
+			for _, target := range g.Targets {
+				if seen[target] {
+					log.Debugf("[%v] skipping duplicate target, from %v", target, name)
+					continue
+				}
+				seen[target] = true
+
+				zk := newZKServer(target)
+				zk.ensemble = g.Labels["ensemble"]
+				if zk.ensemble == "" {
+					zk.ensemble = *ensembleName
+				}
+				for i, label := range targetLabelNames {
+					zk.labels[i] = g.Labels[label]
+				}
+				servers = append(servers, zk)
+			}
+		}
+	}
+	return servers
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"gotest.tools/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zookeeper_exporter")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { *fileSDFiles, *fileSDRefreshInterval, targetLabelNames = "", 0, nil }()
+
+	// bumps the modification time too, so the change is seen even within the file system's time resolution
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		assert.NilError(t, ioutil.WriteFile(path, []byte(content), 0644))
+		future := time.Now().Add(time.Duration(len(content)) * time.Second)
+		assert.NilError(t, os.Chtimes(path, future, future))
+	}
+	write("a.json", `[
+  {"targets": ["10.0.0.1:2181", "10.0.0.2:2181"], "labels": {"ensemble": "a", "env": "prod"}},
+  {"targets": ["10.0.0.3:2181"], "labels": {"dc": "ams"}}
+]`)
+	write("b.yml", `
+- targets: [10.0.0.4:2181, 10.0.0.1:2181]
+  labels: {ensemble: b, __metrics_path__: /metrics}
+`)
+	*fileSDFiles, *fileSDRefreshInterval = filepath.Join(dir, "*.json")+","+filepath.Join(dir, "*.yml"), 30
+
+	d, err := newFileDiscoverer()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, targetLabelNames, []string{"dc", "env"})
+
+	type target struct {
+		IPPort, Ensemble string
+		Labels           []string
+	}
+	targets := func() []target {
+		var got []target
+		for _, zk := range d.servers() {
+			got = append(got, target{zk.ipPort, zk.ensemble, zk.labels})
+		}
+		return got
+	}
+	assert.DeepEqual(t, targets(), []target{
+		{"10.0.0.1:2181", "a", []string{"", "prod"}},
+		{"10.0.0.2:2181", "a", []string{"", "prod"}},
+		{"10.0.0.3:2181", "", []string{"ams", ""}},
+		// 10.0.0.1 is already a member of a
+		{"10.0.0.4:2181", "b", []string{"", ""}},
+	})
+
+	changed, err := d.refresh()
+	assert.NilError(t, err)
+	assert.Assert(t, !changed)
+
+	t.Run("changed file", func(t *testing.T) {
+		write("b.yml", `
+- targets: [10.0.0.5:2181]
+  labels: {ensemble: b, dc: fra}
+`)
+		changed, err := d.refresh()
+		assert.NilError(t, err)
+		assert.Assert(t, changed)
+		assert.DeepEqual(t, targets()[3], target{"10.0.0.5:2181", "b", []string{"fra", ""}})
+	})
+
+	t.Run("new label keeps the last groups", func(t *testing.T) {
+		write("b.yml", `
+- targets: [10.0.0.6:2181]
+  labels: {ensemble: b, rack: r1}
+`)
+		changed, err := d.refresh()
+		assert.ErrorContains(t, err, `new label "rack" needs a restart`)
+		assert.Assert(t, !changed)
+		assert.Equal(t, targets()[3].IPPort, "10.0.0.5:2181")
+	})
+
+	t.Run("removed file", func(t *testing.T) {
+		assert.NilError(t, os.Remove(filepath.Join(dir, "b.yml")))
+		changed, err := d.refresh()
+		assert.NilError(t, err)
+		assert.Assert(t, changed)
+		assert.Equal(t, len(targets()), 3)
+	})
+
+	t.Run("invalid target", func(t *testing.T) {
+		write("c.json", `[{"targets": ["zk1"]}]`)
+		_, err := d.refresh()
+		assert.ErrorContains(t, err, `group #1: target "zk1" is not ip:port`)
+	})
+}
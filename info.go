@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+	"time"
+)
+
+const (
+	confCMD = "conf"
+
+	buildInfo = "build_info"
+	javaInfo  = "java_info"
+	zkConfig  = "config"
+)
+
+// conf keys exported as labels of the config metric, mapped to their label name. The AdminServer's configuration
+// command reports the same keys in snake case, which conveniently is what we want as label names
+var configLabels = []struct{ key, label string }{
+	{"tickTime", "tick_time"},
+	{"initLimit", "init_limit"},
+	{"syncLimit", "sync_limit"},
+	{"maxClientCnxns", "max_client_cnxns"},
+	{"dataDir", "data_dir"},
+	{"dataLogDir", "data_log_dir"},
+	{"serverId", "server_id"},
+}
+
+var (
+	buildInfoLabels  = exporterLabels("version", "revision", "built")
+	javaInfoLabels   = exporterLabels("java_version", "java_vendor", "os_name")
+	configLabelNames = func() []string {
+		var names []string
+		for _, l := range configLabels {
+			names = append(names, l.label)
+		}
+		return exporterLabels(names...)
+	}()
+)
+
+// zkInfo holds the parsed output of the envi and conf commands
+type zkInfo struct {
+	envi    map[string]string
+	conf    map[string]string
+	fetched time.Time
+}
+
+// getInfo runs envi and conf, unless we already did so less than maxAge ago. This stuff rarely changes, so there is
+// no point bothering ZK with it on every poll. The same goes for a server refusing to run them, as the whitelist
+// doesn't change without a restart either
+func (zk *zkServer) getInfo(ctx context.Context, maxAge time.Duration) (*zkInfo, error) {
+	zk.infoMu.Lock()
+	defer zk.infoMu.Unlock()
+
+	if zk.info != nil && time.Since(zk.info.fetched) < maxAge {
+		return zk.info, nil
+	}
+	if !zk.infoRefused.IsZero() && time.Since(zk.infoRefused) < maxAge {
+		return nil, errNotWhitelisted
+	}
+
+	if zk.adminURL != "" {
+		info, err := zk.getAdminInfo(ctx)
+		if err != nil {
+			return nil, err
+		}
+		zk.info = info
+		return zk.info, nil
+	}
+
+	envi, err := zk.sendWhitelistedCommand(ctx, enviCMD)
+	if err != nil {
+		return nil, zk.infoFailed(err)
+	}
+	conf, err := zk.sendWhitelistedCommand(ctx, confCMD)
+	if err != nil {
+		return nil, zk.infoFailed(err)
+	}
+
+	zk.infoRefused = time.Time{}
+	zk.info = &zkInfo{
+		envi:    parseKeyValues(envi),
+		conf:    parseKeyValues(conf),
+		fetched: time.Now(),
+	}
+	return zk.info, nil
+}
+
+// infoFailed remembers when the server refused to run envi or conf, logging it the first time. Must be called with
+// infoMu held
+func (zk *zkServer) infoFailed(err error) error {
+	if err == errNotWhitelisted {
+		if zk.infoRefused.IsZero() {
+			log.Debugf("[%v] envi / conf not whitelisted, not exporting info metrics", zk.ipPort)
+		}
+		zk.infoRefused = time.Now()
+	}
+	return err
+}
+
+// parseKeyValues parses the key=value lines of envi and conf output, skipping anything else (like the
+// "Environment:" header)
+func parseKeyValues(byts []byte) map[string]string {
+	values := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(byts))
+	for scanner.Scan() {
+		splits := strings.SplitN(scanner.Text(), "=", 2)
+		if len(splits) != 2 {
+			continue
+		}
+		values[strings.TrimSpace(splits[0])] = strings.TrimSpace(splits[1])
+	}
+	return values
+}
+
+// splits a zookeeper.version value like "3.5.9-83df9301aa5c2a5d284a9940177808c01bc35cef, built on 01/06/2021 20:03 GMT"
+// into version, revision and build date
+func parseBuildVersion(s string) (version, revision, built string) {
+	splits := strings.SplitN(s, ", built on ", 2)
+	if len(splits) == 2 {
+		built = splits[1]
+	}
+
+	versionSplits := strings.SplitN(splits[0], "-", 2)
+	version = versionSplits[0]
+	if len(versionSplits) == 2 {
+		// 3.6+ versions look like 3.6.2--803c7f1a...
+		revision = strings.TrimLeft(versionSplits[1], "-")
+	}
+	return version, revision, built
+}
+
+// pollInfo refreshes the info metrics of a server; info is only fetched every maxAge
+func pollInfo(ctx context.Context, zk *zkServer, metrics *zkMetrics, maxAge time.Duration) {
+	info, err := zk.getInfo(ctx, maxAge)
+	if err == errNotWhitelisted {
+		// already logged by getInfo
+		return
+	}
+	if err != nil {
+		log.Warnf("[%v] failed to get envi / conf: %v", zk.ipPort, err)
+		return
+	}
+	metrics.refreshInfo(zk.ipPort, info)
+}
+
+// refreshInfo converts envi and conf output into build_info, java_info and config info metrics
+func (m *zkMetrics) refreshInfo(instance string, info *zkInfo) {
+	m.refreshExtra(instance, "info", func() []zkSample {
+		var samples []zkSample
+
+		if v, ok := info.envi["zookeeper.version"]; ok {
+			version, revision, built := parseBuildVersion(v)
+			samples = append(samples, zkSample{
+				desc:   m.descWithHelp(buildInfo, "ZooKeeper build information, from the envi command", buildInfoLabels...),
+				value:  1,
+				labels: []string{version, revision, built},
+			})
+		}
+
+		if len(info.envi) > 0 {
+			samples = append(samples, zkSample{
+				desc:   m.descWithHelp(javaInfo, "JVM and OS running ZooKeeper, from the envi command", javaInfoLabels...),
+				value:  1,
+				labels: []string{info.envi["java.version"], info.envi["java.vendor"], info.envi["os.name"]},
+			})
+		}
+
+		if len(info.conf) > 0 {
+			labelValues := make([]string, 0, len(configLabels))
+			for _, l := range configLabels {
+				labelValues = append(labelValues, info.conf[l.key])
+			}
+			samples = append(samples, zkSample{
+				desc:   m.descWithHelp(zkConfig, "ZooKeeper configuration, from the conf command", configLabelNames...),
+				value:  1,
+				labels: labelValues,
+			})
+		}
+		return samples
+	})
+}
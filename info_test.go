@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testEnvi = `Environment:
+zookeeper.version=3.6.2--803c7f1a12f85978cb049af5e4ef23bd8b688715, built on 09/04/2020 12:44 GMT
+host.name=zk1
+java.version=11.0.9.1
+java.vendor=N/A
+os.name=Linux
+os.arch=amd64
+`
+
+const testConf = `clientPort=2181
+secureClientPort=-1
+dataDir=/data/version-2
+dataDirSize=67108880
+dataLogDir=/datalog/version-2
+dataLogSize=1024
+tickTime=2000
+maxClientCnxns=60
+minSessionTimeout=4000
+maxSessionTimeout=40000
+clientPortListenBacklog=-1
+serverId=1
+initLimit=5
+syncLimit=2
+electionAlg=3
+electionPort=3888
+quorumPort=2888
+peerType=0
+membership: 
+server.1=zk1:2888:3888:participant;0.0.0.0:2181
+version=0
+`
+
+func TestParseBuildVersion(t *testing.T) {
+	version, revision, built := parseBuildVersion("3.6.2--803c7f1a12f85978cb049af5e4ef23bd8b688715, built on 09/04/2020 12:44 GMT")
+	assert.Equal(t, version, "3.6.2")
+	assert.Equal(t, revision, "803c7f1a12f85978cb049af5e4ef23bd8b688715")
+	assert.Equal(t, built, "09/04/2020 12:44 GMT")
+
+	version, revision, built = parseBuildVersion("3.4.14-4c25d480e66aadd371de8bd2fd8da255ac140bcf, built on 03/06/2019 16:18 GMT")
+	assert.Equal(t, version, "3.4.14")
+	assert.Equal(t, revision, "4c25d480e66aadd371de8bd2fd8da255ac140bcf")
+	assert.Equal(t, built, "03/06/2019 16:18 GMT")
+}
+
+func TestRefreshInfo(t *testing.T) {
+	m := newMetrics()
+	m.refresh("zk1:2181", map[string]string{zkOK: "imok"}, nil)
+	m.refreshInfo("zk1:2181", &zkInfo{envi: parseKeyValues([]byte(testEnvi)), conf: parseKeyValues([]byte(testConf))})
+
+	want := `
+# HELP build_info ZooKeeper build information, from the envi command
+# TYPE build_info gauge
+build_info{built="09/04/2020 12:44 GMT",revision="803c7f1a12f85978cb049af5e4ef23bd8b688715",version="3.6.2",zk_instance="zk1:2181"} 1
+# HELP config ZooKeeper configuration, from the conf command
+# TYPE config gauge
+config{data_dir="/data/version-2",data_log_dir="/datalog/version-2",init_limit="5",max_client_cnxns="60",server_id="1",sync_limit="2",tick_time="2000",zk_instance="zk1:2181"} 1
+# HELP java_info JVM and OS running ZooKeeper, from the envi command
+# TYPE java_info gauge
+java_info{java_vendor="N/A",java_version="11.0.9.1",os_name="Linux",zk_instance="zk1:2181"} 1
+`
+	assert.NilError(t, testutil.CollectAndCompare(m, strings.NewReader(want), buildInfo, zkConfig, javaInfo))
+}
+
+func TestGetInfo(t *testing.T) {
+	t.Run("a refusal is cached like the info", func(t *testing.T) {
+		f, zk := startFakeZK(t)
+		defer f.close()
+		f.setResponse(enviCMD, "envi is not executed because it is not in the whitelist.\n")
+
+		for i := 0; i < 3; i++ {
+			_, err := zk.getInfo(context.Background(), time.Minute)
+			assert.Equal(t, err, errNotWhitelisted)
+		}
+		assert.Equal(t, f.requestCount(enviCMD), 1)
+
+		// and expires like it
+		f.setResponse(enviCMD, testEnvi)
+		info, err := zk.getInfo(context.Background(), 0)
+		assert.NilError(t, err)
+		assert.Equal(t, info.envi["java.version"], "11.0.9.1")
+		assert.Equal(t, f.requestCount(enviCMD), 2)
+	})
+}
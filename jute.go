@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Just enough of jute, the serialisation format of the ZooKeeper client protocol, to connect, read, and for the
+// canary write a few znodes. Everything is big endian; strings and buffers are an int32 length followed by the
+// bytes, with -1 meaning null; vectors are an int32 count followed by the elements.
+
+var errJuteShortRead = errors.New("jute: short read")
+
+type juteWriter struct {
+	bytes.Buffer
+}
+
+func (w *juteWriter) writeInt32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	w.Write(b[:])
+}
+
+func (w *juteWriter) writeInt64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	w.Write(b[:])
+}
+
+func (w *juteWriter) writeBool(v bool) {
+	if v {
+		w.WriteByte(1)
+		return
+	}
+	w.WriteByte(0)
+}
+
+func (w *juteWriter) writeBuffer(b []byte) {
+	if b == nil {
+		w.writeInt32(-1)
+		return
+	}
+	w.writeInt32(int32(len(b)))
+	w.Write(b)
+}
+
+func (w *juteWriter) writeString(s string) {
+	w.writeInt32(int32(len(s)))
+	w.WriteString(s)
+}
+
+// juteReader decodes a jute record. The first error sticks, so callers can read a whole record and check err once
+type juteReader struct {
+	buf []byte
+	off int
+	err error
+}
+
+func newJuteReader(buf []byte) *juteReader {
+	return &juteReader{buf: buf}
+}
+
+func (r *juteReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.off+n > len(r.buf) {
+		r.err = errJuteShortRead
+		return nil
+	}
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+// remaining is the number of bytes left to read
+func (r *juteReader) remaining() int {
+	return len(r.buf) - r.off
+}
+
+func (r *juteReader) readInt32() int32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (r *juteReader) readInt64() int64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (r *juteReader) readBool() bool {
+	b := r.next(1)
+	return b != nil && b[0] != 0
+}
+
+func (r *juteReader) readBuffer() []byte {
+	n := r.readInt32()
+	if n == -1 || r.err != nil {
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *juteReader) readString() string {
+	return string(r.readBuffer())
+}
+
+// zkStat is the jute Stat record every znode has
+type zkStat struct {
+	czxid          int64
+	mzxid          int64
+	ctime          int64
+	mtime          int64
+	version        int32
+	cversion       int32
+	aversion       int32
+	ephemeralOwner int64
+	dataLength     int32
+	numChildren    int32
+	pzxid          int64
+}
+
+func (r *juteReader) readStat() zkStat {
+	return zkStat{
+		czxid:          r.readInt64(),
+		mzxid:          r.readInt64(),
+		ctime:          r.readInt64(),
+		mtime:          r.readInt64(),
+		version:        r.readInt32(),
+		cversion:       r.readInt32(),
+		aversion:       r.readInt32(),
+		ephemeralOwner: r.readInt64(),
+		dataLength:     r.readInt32(),
+		numChildren:    r.readInt32(),
+		pzxid:          r.readInt64(),
+	}
+}
+
+// zkError is an error code returned by the server in a reply header
+type zkError int32
+
+const (
+	zkErrNoNode     zkError = -101
+	zkErrNoAuth     zkError = -102
+	zkErrBadVersion zkError = -103
+	zkErrNodeExists zkError = -110
+	zkErrNotEmpty   zkError = -111
+)
+
+var zkErrorNames = map[zkError]string{
+	-1:              "system error",
+	-4:              "connection loss",
+	-7:              "operation timeout",
+	-8:              "bad arguments",
+	-100:            "api error",
+	zkErrNoNode:     "node does not exist",
+	zkErrNoAuth:     "not authenticated",
+	zkErrBadVersion: "bad version",
+	zkErrNodeExists: "node already exists",
+	zkErrNotEmpty:   "node has children",
+	-112:            "session expired",
+	-115:            "authentication failed",
+	-118:            "session moved",
+	-119:            "not read only",
+}
+
+func (e zkError) Error() string {
+	if name, ok := zkErrorNames[e]; ok {
+		return "zookeeper: " + name
+	}
+	return fmt.Sprintf("zookeeper: error %d", int32(e))
+}
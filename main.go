@@ -1,12 +1,15 @@
 package main
 
 import (
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/alecthomas/kingpin.v2"
+	"net"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -21,16 +24,36 @@ var (
 		"Address on which to expose metrics",
 	).Default("127.0.0.1:9898").String()
 
+	shutdownTimeout = app.Flag(
+		"web.shutdown-timeout",
+		"How long to wait for in flight requests to finish on SIGTERM or SIGINT (s)",
+	).Default("10").Int()
+
 	zkHostString = app.Flag(
 		"zk.hosts",
-		"list of ip:port of ZK hosts, comma separated",
-	).Required().String()
+		"list of ip:port of ZK hosts, http(s):// AdminServer URLs, or dns+host:port and dnssrv+name targets resolved every zk.dns-refresh-interval, comma separated. If empty, only the /probe endpoint is served",
+	).Default("").String()
+
+	ensembleName = app.Flag(
+		"zk.ensemble-name",
+		"Name of the ensemble the zk.hosts belong to, used to label the derived ensemble_* metrics",
+	).Default("default").String()
 
 	pollInterval = app.Flag(
 		"zk.poll-interval",
 		"How often to poll the ZK servers",
 	).Default("30").Int()
 
+	dnsRefreshInterval = app.Flag(
+		"zk.dns-refresh-interval",
+		"How often to resolve dns+host:port and dnssrv+name targets again (s), 0 to only resolve them on startup and reload",
+	).Default("30").Int()
+
+	infoPollInterval = app.Flag(
+		"zk.info-poll-interval",
+		"How often to refresh build, java and config info from the envi and conf commands (s), 0 to disable",
+	).Default("300").Int()
+
 	zkTimeout = app.Flag(
 		"zk.connect-timeout",
 		"Timeout value for opening socket to ZK (s)",
@@ -41,11 +64,167 @@ var (
 		"Connection deadline for read & write operations (s)",
 	).Default("3").Float()
 
+	zkTLSEnabled = app.Flag(
+		"zk.tls.enabled",
+		"Send four letter words over TLS, to ZK's secureClientPort",
+	).Default("false").Bool()
+
+	zkTLSCAFile = app.Flag(
+		"zk.tls.ca-file",
+		"CA bundle to verify ZK's certificate with. Uses the system roots if empty",
+	).Default("").String()
+
+	zkTLSCertFile = app.Flag(
+		"zk.tls.cert-file",
+		"Client certificate to present to ZK, for mutual TLS",
+	).Default("").String()
+
+	zkTLSKeyFile = app.Flag(
+		"zk.tls.key-file",
+		"Key of the client certificate",
+	).Default("").String()
+
+	zkTLSServerName = app.Flag(
+		"zk.tls.server-name",
+		"Server name to verify ZK's certificate against. Defaults to the host of each zk.hosts entry",
+	).Default("").String()
+
+	zkTLSMinVersion = app.Flag(
+		"zk.tls.min-version",
+		"Minimum TLS version",
+	).Default("1.2").Enum("1.0", "1.1", "1.2", "1.3")
+
+	collectionMode = app.Flag(
+		"zk.collection-mode",
+		"poll: poll ZK servers in the background every zk.poll-interval. scrape: poll them when /metrics is scraped",
+	).Default("poll").Enum("poll", "scrape")
+
+	zxidEnabled = app.Flag(
+		"collector.zxid",
+		"Run srvr on every poll for the zxid mntr doesn't report, and export zk_zxid, zk_epoch, zk_last_zxid_counter and ensemble_zxid_spread",
+	).Default("false").Bool()
+
+	consEnabled = app.Flag(
+		"collector.cons",
+		"Run the cons command on every poll, and export per client IP connection metrics",
+	).Default("false").Bool()
+
+	consMaxClients = app.Flag(
+		"cons.max-clients",
+		"Maximum number of client IPs exported per ZK server, the rest are aggregated as client_ip=\"other\". 0 for no limit",
+	).Default("100").Int()
+
+	consAllowCIDRs = app.Flag(
+		"cons.allow-cidrs",
+		"Comma separated list of CIDRs; if set, only clients within them are exported",
+	).Default("").String()
+
+	consDenyCIDRs = app.Flag(
+		"cons.deny-cidrs",
+		"Comma separated list of CIDRs whose clients are never exported",
+	).Default("").String()
+
+	wchsEnabled = app.Flag(
+		"collector.wchs",
+		"Run the wchs command on every poll, and export watch totals",
+	).Default("false").Bool()
+
+	wchcEnabled = app.Flag(
+		"collector.wchc",
+		"Run the wchc command on every poll, and export the sessions with the most watches",
+	).Default("false").Bool()
+
+	wchpEnabled = app.Flag(
+		"collector.wchp",
+		"Run the wchp command on every poll, and export the path prefixes with the most watches",
+	).Default("false").Bool()
+
+	wchPathDepth = app.Flag(
+		"wch.path-depth",
+		"Number of path components wchp watches are aggregated by, e.g. 2 aggregates /app/locks/lock-1 as /app/locks",
+	).Default("2").Int()
+
+	wchTopN = app.Flag(
+		"wch.top-n",
+		"Number of sessions / path prefixes with the most watches exported by wchc / wchp. 0 for no limit",
+	).Default("20").Int()
+
+	wchMaxWatches = app.Flag(
+		"wch.max-watches",
+		"Skip the expensive wchc / wchp commands if the server has more watches than this. 0 for no limit",
+	).Default("100000").Int()
+
+	clientProbeEnabled = app.Flag(
+		"collector.client-probe",
+		"On every poll, establish a client session and read a znode, exporting how long it took",
+	).Default("false").Bool()
+
+	clientProbeZnode = app.Flag(
+		"client-probe.znode",
+		"Znode the client probe reads",
+	).Default("/zookeeper").String()
+
+	clientProbeSessionTimeout = app.Flag(
+		"client-probe.session-timeout",
+		"Session timeout the client probe asks for (s)",
+	).Default("10").Int()
+
+	canaryEnabled = app.Flag(
+		"collector.canary",
+		"On every poll, write a znode through one member of each ensemble and read it back through the others. "+
+			"The only collector that writes to zookeeper",
+	).Default("false").Bool()
+
+	canaryPath = app.Flag(
+		"canary.path",
+		"Parent znode of the canary znodes, created if missing",
+	).Default("/zookeeper_exporter/canary").String()
+
+	canaryTimeout = app.Flag(
+		"canary.timeout",
+		"How long a canary round, including waiting for every member to return the znode, may take (s)",
+	).Default("5").Int()
+
+	treeEnabled = app.Flag(
+		"collector.tree",
+		"Periodically crawl the --tree.roots subtrees, and export their znode counts and sizes",
+	).Default("false").Bool()
+
+	treeRootsList = app.Flag(
+		"tree.roots",
+		"Comma separated list of znodes whose subtrees are crawled, e.g. /app1,/app2",
+	).Default("").String()
+
+	treeInterval = app.Flag(
+		"tree.interval",
+		"How often to crawl the znode tree (s)",
+	).Default("300").Int()
+
+	treeMaxDepth = app.Flag(
+		"tree.max-depth",
+		"How many levels below each root to crawl. 0 for no limit",
+	).Default("10").Int()
+
+	treeMaxZnodes = app.Flag(
+		"tree.max-znodes",
+		"Maximum number of znodes visited per crawl of a ZK server. 0 for no limit",
+	).Default("10000").Int()
+
+	treeRate = app.Flag(
+		"tree.rate",
+		"Maximum number of requests per second a crawl sends to a ZK server. 0 for no limit",
+	).Default("100").Int()
+
 	metricsNamespace = app.Flag(
 		"metrics.namespace",
 		"string to prepend to all metric names",
 	).Default("zookeeper__").String()
 
+	legacyGauges = app.Flag(
+		"metrics.legacy-gauges",
+		"Also export counters and summaries as gauges under their old mntr names. Deprecated, for migrating dashboards",
+	).Bool()
+
 	consulName = app.Flag(
 		"consul.service-name",
 		"If defined, register zookeeper_exporter with local consul agent",
@@ -61,57 +240,242 @@ var (
 		"consul service TTL - consul will mark service unhealthy if zookeeper_exporter is down for this long (s). Consul will also unregister the service entirely after this service has been unhealthy for this long * 10",
 	).Default("60").Int()
 
+	consulSDService = app.Flag(
+		"consul.sd.service",
+		"Discover the ZK servers to poll from the instances of this consul catalog service, instead of --zk.hosts",
+	).Default("").String()
+
+	consulSDTag = app.Flag(
+		"consul.sd.tag",
+		"Only discover instances of consul.sd.service with this tag",
+	).Default("").String()
+
+	consulSDEnsembleMeta = app.Flag(
+		"consul.sd.ensemble-meta",
+		"Service meta key holding the ensemble an instance belongs to. Instances without it belong to zk.ensemble-name",
+	).Default("ensemble").String()
+
+	consulSDMetaLabels = app.Flag(
+		"consul.sd.meta-labels",
+		"Comma separated list of service meta keys, added as labels to every metric of an instance",
+	).Default("").String()
+
+	fileSDFiles = app.Flag(
+		"file-sd.files",
+		"Comma separated list of prometheus file_sd JSON or YAML files (globs allowed) to read the ZK servers to poll from, instead of --zk.hosts",
+	).Default("").String()
+
+	fileSDRefreshInterval = app.Flag(
+		"file-sd.refresh-interval",
+		"How often to check the file-sd.files for changes (s)",
+	).Default("30").Int()
+
+	configFile = app.Flag(
+		"config.file",
+		"YAML file listing the ensembles to poll, with per ensemble labels and settings. Replaces --zk.hosts",
+	).Default("").String()
+
+	// the flags above are app wide, so `zookeeper_exporter --zk.hosts=...` keeps working without naming a command
+	serveCmd = app.Command("serve", "Poll ZooKeeper and serve its metrics (the default)").Default()
+
+	checkConfigCmd = app.Command("check-config", "Validate the --config.file and exit")
+
+	analyzeCmd = app.Command("analyze", "Analyze the snapshot and txnlogs of a ZooKeeper dataDir, without ZooKeeper running")
+
+	analyzeDataDirPath = analyzeCmd.Flag(
+		"data-dir",
+		"ZooKeeper dataDir, or its version-2 subdirectory",
+	).Required().String()
+
+	analyzeTxnLogDir = analyzeCmd.Flag(
+		"txn-log-dir",
+		"ZooKeeper dataLogDir, if txnlogs aren't kept in --data-dir",
+	).Default("").String()
+
+	analyzeFormat = analyzeCmd.Flag(
+		"format",
+		"Output format: text, json, or prometheus for node_exporter's textfile collector",
+	).Default("text").Enum("text", "json", "prometheus")
+
+	analyzePathDepth = analyzeCmd.Flag(
+		"path-depth",
+		"Number of path components znodes and transactions are aggregated by",
+	).Default("2").Int()
+
+	analyzeTopN = analyzeCmd.Flag(
+		"top-n",
+		"Number of largest znodes reported. 0 for all of them",
+	).Default("10").Int()
+
+	fakeZKCmd = app.Command("fake-zk", "Run a fake ZooKeeper answering four letter words, for demos and testing")
+
+	fakeZKListenAddress = fakeZKCmd.Flag(
+		"listen-address",
+		"Address the fake ZooKeeper listens on",
+	).Default("127.0.0.1:2181").String()
+
+	fakeZKMode = fakeZKCmd.Flag(
+		"mode",
+		"Server state to report: leader, follower, standalone or observer",
+	).Default("leader").Enum(fakeZKModes...)
+
+	fakeZKNotServing = fakeZKCmd.Flag(
+		"not-serving",
+		"Answer like a server that lost its quorum: \"This ZooKeeper instance is not currently serving requests\"",
+	).Default("false").Bool()
+
+	fakeZKReadOnly = fakeZKCmd.Flag(
+		"read-only",
+		"Answer isro with ro",
+	).Default("false").Bool()
+
+	fakeZKDelay = fakeZKCmd.Flag(
+		"delay",
+		"How long to wait before answering (ms)",
+	).Default("0").Int()
+
+	recordCmd = app.Command("record", "Capture the raw responses of a live ZooKeeper to every four letter word the exporter sends, as test fixtures")
+
+	recordTarget = recordCmd.Flag(
+		"target",
+		"ip:port of the ZooKeeper to record",
+	).Required().String()
+
+	recordOutput = recordCmd.Flag(
+		"output",
+		"Directory to write the responses to, one file per command",
+	).Required().String()
+
 	log = logrus.New()
 )
 
-func setup() {
+// setup parses the command line and, for the serve command, sets everything up. Returns the command to run
+func setup() string {
 	log.SetOutput(os.Stdout)
 	log.SetLevel(logrus.DebugLevel)
 
 	app.Version(Version)
 	app.HelpFlag.Short('h')
-	if _, err := app.Parse(os.Args[1:]); err != nil {
+	command, err := app.Parse(os.Args[1:])
+	if err != nil {
 		log.Fatal("Couldn't parse command line args")
 	}
+	if command != serveCmd.FullCommand() {
+		// keep stdout for the command's output
+		log.SetOutput(os.Stderr)
+	}
+	if command == analyzeCmd.FullCommand() || command == fakeZKCmd.FullCommand() {
+		return command
+	}
 
-	// Register w/ consul if *consulName defined on cmd line
-	if *consulName != "" {
-		if err := registerWithConsulAgent(*consulName, *consulTags, *bindHostPort, *consulTTL); err != nil {
-			log.Fatalf("failed to register with consul: %s", err)
-		}
+	if err := setupConsFilters(); err != nil {
+		log.Fatal(err)
 	}
+	if err := setupTLS(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupCanary(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupTree(); err != nil {
+		log.Fatal(err)
+	}
+	return command
 }
 
 func main() {
-	setup()
-	zkHosts := strings.Split(*zkHostString, ",")
-	if *zkHostString == "" || len(zkHosts) < 1 {
-		log.Fatal("Need to define zookeeper servers to monitor")
+	switch setup() {
+	case analyzeCmd.FullCommand():
+		if err := runAnalyze(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case checkConfigCmd.FullCommand():
+		if err := runCheckConfig(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case recordCmd.FullCommand():
+		if err := runRecord(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case fakeZKCmd.FullCommand():
+		if err := runFakeZK(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// the servers are either discovered, or loaded from the flags or config file
+	var zkServers []*zkServer
+	var discovery discoverer
+	var err error
+	switch {
+	case *consulSDService != "":
+		discovery, err = newConsulDiscoverer()
+	case *fileSDFiles != "":
+		discovery, err = newFileDiscoverer()
+	default:
+		zkServers, err = loadTargets(true)
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	log.Printf("Starting zookeeper_exporter v%v", Version)
 	log.Printf("Listening on http://%v", *bindHostPort)
-	log.Printf("Polling %v zookeeper servers every %ds", len(zkHosts), *pollInterval)
-	log.Debugf("ZK Servers: %q", zkHosts)
+	switch {
+	case discovery != nil:
+		log.Printf("Polling the zookeeper servers of %v", discovery)
+	case len(zkServers) == 0:
+		log.Printf("No zookeeper servers defined, only serving /probe")
+	case *collectionMode == "scrape":
+		log.Printf("Polling %v zookeeper servers on every scrape", len(zkServers))
+	default:
+		log.Printf("Polling %v zookeeper servers", len(zkServers))
+	}
+	for _, zk := range zkServers {
+		log.Debugf("ZK Server: %v, ensemble %q, every %v", zk.ipPort, zk.ensemble, zk.pollInterval)
+	}
 
-	// convert int to time.Duration
-	intervalDuration := time.Duration(*pollInterval) * time.Second
+	// Start http handler & server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/probe", probeHandler)
 
-	// Create new metrics interface
-	metrics := newMetrics()
+	// in poll mode, the target manager runs one poller per server, and a canary per ensemble that has it enabled
+	var metrics *zkMetrics
+	if *collectionMode != "scrape" {
+		metrics = newMetrics()
+		prometheus.MustRegister(metrics)
+	}
+	targets := newTargetManager(metrics)
+	prometheus.MustRegister(targets)
+	if discovery != nil {
+		targets.discover(discovery)
+	} else {
+		targets.apply(zkServers)
+	}
 
-	// Start one poller per server
-	for _, ipport := range zkHosts {
-		if !strings.Contains(ipport, ":") {
-			log.Fatalf("zookeeper host \"%s\" is not ip:port format", ipport)
-		}
-		p := newPoller(intervalDuration, *metrics, *newZKServer(ipport))
-		go p.pollForMetrics()
+	if *collectionMode == "scrape" {
+		mux.Handle("/metrics", scrapeHandler(targets))
+	} else {
+		mux.Handle("/metrics", promhttp.Handler())
 	}
 
-	// Start http handler & server
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	// reload the targets on SIGHUP or POST /-/reload
+	mux.HandleFunc("/-/reload", targets.reloadHandler)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := targets.reload(); err != nil {
+				log.Errorf("failed to reload: %v", err)
+				continue
+			}
+			log.Infof("reloaded")
+		}
+	}()
 
 	srv := &http.Server{
 		Addr:         *bindHostPort,
@@ -119,8 +483,18 @@ func main() {
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
-
-	if err := srv.ListenAndServe(); err != nil {
+	ln, err := net.Listen("tcp", *bindHostPort)
+	if err != nil {
 		log.Fatal(err)
 	}
+
+	// Register w/ consul if *consulName defined on cmd line, now that there is something to scrape
+	sr, err := registerWithConsulAgent(*consulName, *consulTags, *bindHostPort, *consulTTL)
+	if err != nil {
+		log.Fatalf("failed to register with consul: %s", err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	os.Exit(serveUntilSignalled(srv, ln, stop, targets, sr, time.Duration(*shutdownTimeout)*time.Second))
 }
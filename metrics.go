@@ -1,7 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type serverState float64
@@ -26,8 +32,19 @@ const (
 	zkPendingSyncs            = "zk_pending_syncs"
 	zkServerState             = "zk_server_state"
 	zkFsyncThresholdExceeded  = "zk_fsync_threshold_exceed_count"
+	zkResponseCacheHits       = "zk_response_packet_cache_hits"
+	zkResponseCacheMisses     = "zk_response_packet_cache_misses"
+	zkBytesReceived           = "zk_bytes_received_count"
+	zkDigestMismatches        = "zk_digest_mismatches_count"
 	zkVersion                 = "zk_version"
+	zkZxid                    = "zk_zxid"
+	zkEpoch                   = "zk_epoch"
+	zkLastZxidCounter         = "zk_last_zxid_counter"
+	zkReadLatency             = "zk_readlatency"
+	zkUpdateLatency           = "zk_updatelatency"
 	pollerFailuresTotal       = "polling_failures_total"
+	zkUp                      = "up"
+	lastSuccessfulPoll        = "last_successful_poll_timestamp_seconds"
 
 	zkOK = "zk_ok"
 
@@ -38,23 +55,255 @@ const (
 	standalone serverState = 3
 )
 
+// curated help text for the mntr keys we know about. Any other numeric key reported by mntr is still exported, with a
+// generic help string - see helpFor()
+var knownMetrics = map[string]string{
+	zkAvgLatency:              "Average Latency for ZooKeeper network requests",
+	zkMinLatency:              "Minimum latency for Zookeeper network requests.",
+	zkMaxLatency:              "Maximum latency for ZooKeeper network requests",
+	zkPacketsReceived:         "Number of network packets received by the ZooKeeper instance.",
+	zkPacketsSent:             "Number of network packets sent by the ZooKeeper instance.",
+	zkNumAliveConnections:     "Number of currently alive connections to the ZooKeeper instance.",
+	zkOutstandingRequests:     "Number of requests currently waiting in the queue.",
+	zkZnodeCount:              "Znode count",
+	zkWatchCount:              "Watch count",
+	zkEphemeralsCount:         "Ephemerals Count",
+	zkApproximateDataSize:     "Approximate data size",
+	zkOpenFileDescriptorCount: "Number of currently open file descriptors",
+	zkMaxFileDescriptorCount:  "Maximum number of open file descriptors",
+	zkServerState:             "Current state of the zk instance: 1 = follower, 2 = leader, 3 = standalone, -1 if unknown",
+	zkFollowers:               "Leader only: number of followers.",
+	zkSyncedFollowers:         "Leader only: number of followers currently in sync",
+	zkPendingSyncs:            "Current number of pending syncs",
+	zkOK:                      "Is ZooKeeper currently OK",
+	zkFsyncThresholdExceeded:  "Number of times File sync exceeded fsyncWarningThresholdMS",
+	zkResponseCacheHits:       "Number of responses served from the response packet cache",
+	zkResponseCacheMisses:     "Number of responses that missed the response packet cache",
+	zkBytesReceived:           "Number of bytes received by the ZooKeeper instance",
+	zkDigestMismatches:        "Number of times the data tree digest didn't match the leader's",
+	zkVersion:                 "Zookeeper version",
+	zkZxid:                    "Last zxid seen by the zk instance, from the srvr command",
+	zkEpoch:                   "Epoch of the last zxid seen by the zk instance (high 32 bits of the zxid)",
+	zkLastZxidCounter:         "Transaction counter of the last zxid seen by the zk instance (low 32 bits of the zxid)",
+	zkReadLatency:             "Latency of read requests, in milliseconds",
+	zkUpdateLatency:           "Latency of update requests, in milliseconds",
+}
+
+// how an mntr key is exported
+type metricType int
+
+const (
+	// the value as is; anything mntr reports that we don't know about
+	gaugeMetric metricType = iota
+	// monotonic, only reset when the zk instance restarts. Exported with a _total suffix, see counterName()
+	counterMetric
+	// a string, exported as a label of a sample that is always 1
+	infoMetric
+	// several keys put back together, see summaryFamilies()
+	summaryMetric
+)
+
+func (t metricType) String() string {
+	switch t {
+	case counterMetric:
+		return "counter"
+	case infoMetric:
+		return "info"
+	case summaryMetric:
+		return "summary"
+	default:
+		return "gauge"
+	}
+}
+
+// descKey identifies a descriptor. Two keys of a different type can end up with the same metric name, e.g. a gauge
+// zk_foo_total next to a counter zk_foo, so the name alone isn't enough
+type descKey struct {
+	name string
+	typ  metricType
+}
+
+// the type of the mntr keys that aren't gauges
+var metricTypes = map[string]metricType{
+	zkPacketsReceived:        counterMetric,
+	zkPacketsSent:            counterMetric,
+	zkFsyncThresholdExceeded: counterMetric,
+	zkResponseCacheHits:      counterMetric,
+	zkResponseCacheMisses:    counterMetric,
+	zkBytesReceived:          counterMetric,
+	zkDigestMismatches:       counterMetric,
+	zkVersion:                infoMetric,
+
+	// the other counters of ZooKeeper 3.6+'s ServerMetrics
+	"zk_add_dead_watcher_stall_time":                  counterMetric,
+	"zk_auth_failed_count":                            counterMetric,
+	"zk_cnxn_closed_without_zk_server_running":        counterMetric,
+	"zk_commit_count":                                 counterMetric,
+	"zk_commits_queued":                               counterMetric,
+	"zk_connection_drop_count":                        counterMetric,
+	"zk_connection_rejected":                          counterMetric,
+	"zk_connection_request_count":                     counterMetric,
+	"zk_connection_revalidate_count":                  counterMetric,
+	"zk_dead_watchers_cleared":                        counterMetric,
+	"zk_dead_watchers_queued":                         counterMetric,
+	"zk_diff_count":                                   counterMetric,
+	"zk_ensemble_auth_fail":                           counterMetric,
+	"zk_ensemble_auth_skip":                           counterMetric,
+	"zk_ensemble_auth_success":                        counterMetric,
+	"zk_insecure_admin_count":                         counterMetric,
+	"zk_large_requests_rejected":                      counterMetric,
+	"zk_learner_commit_received_count":                counterMetric,
+	"zk_learner_proposal_received_count":              counterMetric,
+	"zk_looking_count":                                counterMetric,
+	"zk_non_mtls_local_conn_count":                    counterMetric,
+	"zk_non_mtls_remote_conn_count":                   counterMetric,
+	"zk_outstanding_changes_queued":                   counterMetric,
+	"zk_outstanding_changes_removed":                  counterMetric,
+	"zk_prep_processor_request_queued":                counterMetric,
+	"zk_proposal_count":                               counterMetric,
+	"zk_quit_leading_due_to_disloyal_voter":           counterMetric,
+	"zk_request_commit_queued":                        counterMetric,
+	"zk_request_throttle_wait_count":                  counterMetric,
+	"zk_response_packet_get_children_cache_hits":      counterMetric,
+	"zk_response_packet_get_children_cache_misses":    counterMetric,
+	"zk_revalidate_count":                             counterMetric,
+	"zk_sessionless_connections_expired":              counterMetric,
+	"zk_skip_learner_request_to_next_processor_count": counterMetric,
+	"zk_snap_count":                                   counterMetric,
+	"zk_stale_replies":                                counterMetric,
+	"zk_stale_requests":                               counterMetric,
+	"zk_stale_requests_dropped":                       counterMetric,
+	"zk_stale_sessions_expired":                       counterMetric,
+	"zk_sync_processor_request_queued":                counterMetric,
+	"zk_tls_handshake_exceeded":                       counterMetric,
+	"zk_unrecoverable_error_count":                    counterMetric,
+}
+
+// counterName returns the metric name of a counter mntr key: a _count suffix is replaced by _total, anything else gets
+// _total appended
+func counterName(key string) string {
+	return sanitiseMetricName(strings.TrimSuffix(key, "_count")) + "_total"
+}
+
+// a single exported value, with any label values beyond zk_instance
+type zkSample struct {
+	desc   *prometheus.Desc
+	value  float64
+	labels []string
+	// exported as a counter rather than a gauge
+	counter bool
+	// exported as a summary rather than value, if set
+	summary *summaryFamily
+}
+
+// metric returns the sample as a prometheus metric, with label values labels
+func (s zkSample) metric(labels []string) prometheus.Metric {
+	switch {
+	case s.summary != nil:
+		return prometheus.MustNewConstSummary(s.desc, s.summary.count, s.summary.sum, s.summary.quantiles, labels...)
+	case s.counter:
+		return prometheus.MustNewConstMetric(s.desc, prometheus.CounterValue, s.value, labels...)
+	default:
+		return prometheus.MustNewConstMetric(s.desc, prometheus.GaugeValue, s.value, labels...)
+	}
+}
+
+// everything we know about one zk instance as of its last poll
+type instanceState struct {
+	ensemble string
+	// values of the targetLabelNames labels
+	labels []string
+	// mntr key -> sample; empty if the last poll failed, so we never export frozen values
+	samples     map[string]zkSample
+	up          bool
+	lastSuccess time.Time
+	// raw zxid, as float64 samples lose precision
+	zxid    uint64
+	hasZxid bool
+	// samples of the optional collectors (info, cons, ...), keyed by collector name
+	extra map[string][]zkSample
+}
+
+// metricLabels returns the label values of one of the instance's samples: zk_instance, the targetLabelNames, then
+// extra
+func (s *instanceState) metricLabels(instance string, extra ...string) []string {
+	labels := make([]string, 0, 1+len(targetLabelNames)+len(extra))
+	labels = append(labels, instance)
+	for i := range targetLabelNames {
+		value := ""
+		if i < len(s.labels) {
+			value = s.labels[i]
+		}
+		labels = append(labels, value)
+	}
+	return append(labels, extra...)
+}
+
+// zkMetrics holds the latest stats of every zk instance we know about, and exports them as prometheus metrics. Metrics
+// are created on the fly for whatever keys mntr reports, so it implements prometheus.Collector itself rather than
+// registering a fixed set of gauges.
 type zkMetrics struct {
-	gauges                map[string]*prometheus.GaugeVec
-	pollingFailureCounter *prometheus.CounterVec
+	mu        sync.Mutex
+	instances map[string]*instanceState
+	// metric name and type -> descriptor, so we only build each one once
+	descs map[descKey]*prometheus.Desc
+	// warnings already logged, see warnOnce()
+	warned map[string]bool
+	// ensemble -> outcome of the last canary round
+	canaries map[string]canaryResult
+
+	upDesc                 *prometheus.Desc
+	lastSuccessfulPollDesc *prometheus.Desc
+	ensembleDescs          ensembleDescs
+	pollingFailureCounter  *prometheus.CounterVec
 }
 
 func newMetrics() *zkMetrics {
-	// Create an internal metric to count polling failures
-	failureCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+	return &zkMetrics{
+		instances: make(map[string]*instanceState),
+		descs:     make(map[descKey]*prometheus.Desc),
+		warned:    make(map[string]bool),
+		canaries:  make(map[string]canaryResult),
+		upDesc: prometheus.NewDesc(
+			prependNamespace(zkUp),
+			"Whether the zk instance answered the last poll",
+			instanceLabelNames(), nil,
+		),
+		lastSuccessfulPollDesc: prometheus.NewDesc(
+			prependNamespace(lastSuccessfulPoll),
+			"Unix timestamp of the last successful poll of the zk instance",
+			instanceLabelNames(), nil,
+		),
+		ensembleDescs:         newEnsembleDescs(),
+		pollingFailureCounter: newFailureCounter(),
+	}
+}
+
+// Create an internal metric to count polling failures
+func newFailureCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: prependNamespace(pollerFailuresTotal),
 		Help: "Polling failure count",
-	}, []string{"zk_instance"})
-	prometheus.MustRegister(failureCounter)
+	}, instanceLabelNames())
+}
 
-	return &zkMetrics{
-		gauges:                initGauges(),
-		pollingFailureCounter: failureCounter,
+// the label names of the exporter's own metrics, as declared by exporterLabels. See reservedLabels
+var usedLabels = make(map[string]bool)
+
+// exporterLabels declares names as label names used by the exporter's metrics, and returns them
+func exporterLabels(names ...string) []string {
+	for _, name := range names {
+		usedLabels[name] = true
 	}
+	return names
+}
+
+var instanceLabels = exporterLabels("zk_instance")
+
+// instanceLabelNames returns the label names of a per instance metric: zk_instance, the targetLabelNames, then extra
+func instanceLabelNames(extra ...string) []string {
+	names := append(append([]string(nil), instanceLabels...), targetLabelNames...)
+	return append(names, extra...)
 }
 
 func getState(s string) serverState {
@@ -75,116 +324,268 @@ func prependNamespace(rawMetricName string) string {
 	return *metricsNamespace + rawMetricName
 }
 
-// Creates a map of all known metrics exposed by zookeeper's mntr command
-// literal metric name maps to a prometheus Gauge with label zk_instance set to zk's address
-func initGauges() map[string]*prometheus.GaugeVec {
-
-	allMetrics := make(map[string]*prometheus.GaugeVec)
-
-	allMetrics[zkAvgLatency] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkAvgLatency),
-		Help: "Average Latency for ZooKeeper network requests",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkMinLatency] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkMinLatency),
-		Help: "Minimum latency for Zookeeper network requests.",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkMaxLatency] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkMaxLatency),
-		Help: "Maximum latency for ZooKeeper network requests",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkPacketsReceived] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkPacketsReceived),
-		Help: "Number of network packets received by the ZooKeeper instance.",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkPacketsSent] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkPacketsSent),
-		Help: "Number of network packets sent by the ZooKeeper instance.",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkNumAliveConnections] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkNumAliveConnections),
-		Help: "Number of currently alive connections to the ZooKeeper instance.",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkOutstandingRequests] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkOutstandingRequests),
-		Help: "Number of requests currently waiting in the queue.",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkZnodeCount] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkZnodeCount),
-		Help: "Znode count",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkWatchCount] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkWatchCount),
-		Help: "Watch count",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkEphemeralsCount] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkEphemeralsCount),
-		Help: "Ephemerals Count",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkApproximateDataSize] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkApproximateDataSize),
-		Help: "Approximate data size",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkOpenFileDescriptorCount] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkOpenFileDescriptorCount),
-		Help: "Number of currently open file descriptors",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkMaxFileDescriptorCount] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkMaxFileDescriptorCount),
-		Help: "Maximum number of open file descriptors",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkServerState] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkServerState),
-		Help: "Current state of the zk instance: 1 = follower, 2 = leader, 3 = standalone, -1 if unknown",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkFollowers] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkFollowers),
-		Help: "Leader only: number of followers.",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkSyncedFollowers] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkSyncedFollowers),
-		Help: "Leader only: number of followers currently in sync",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkPendingSyncs] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkPendingSyncs),
-		Help: "Current number of pending syncs",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkOK] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkOK),
-		Help: "Is ZooKeeper currently OK",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkFsyncThresholdExceeded] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkFsyncThresholdExceeded),
-		Help: "Number of times File sync exceeded fsyncWarningThresholdMS",
-	}, []string{"zk_instance"})
-
-	allMetrics[zkVersion] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: prependNamespace(zkVersion),
-		Help: "Zookeeper version",
-	}, []string{"zk_instance", "zk_version"})
-
-	// Register all gauges with prometheus registry so they're exposed by promhttp Handler
-	for _, metric := range allMetrics {
-		prometheus.MustRegister(metric)
-	}
-
-	return allMetrics
+// sanitiseMetricName turns an arbitrary mntr key into a valid prometheus metric name: anything outside [a-zA-Z0-9_:]
+// becomes an underscore, and a leading digit gets an underscore prepended
+func sanitiseMetricName(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// returns the curated help text for known keys, or a generic one for anything else
+func helpFor(key string) string {
+	if help, ok := knownMetrics[key]; ok {
+		return help
+	}
+	return fmt.Sprintf("Value of %s as reported by the mntr command", key)
+}
+
+// returns the descriptor for a gauge, creating it on first use. Caller must hold m.mu
+func (m *zkMetrics) descWithHelp(name, help string, extraLabels ...string) *prometheus.Desc {
+	return m.typedDesc(name, help, gaugeMetric, extraLabels...)
+}
+
+// returns the descriptor for a metric name of type typ, creating it on first use. A name can only be exported with one
+// type, so if it already is with another one, it returns nil after a warning. Caller must hold m.mu
+func (m *zkMetrics) typedDesc(name, help string, typ metricType, extraLabels ...string) *prometheus.Desc {
+	name = prependNamespace(name)
+	if d, ok := m.descs[descKey{name, typ}]; ok {
+		return d
+	}
+	for _, other := range []metricType{gaugeMetric, counterMetric, infoMetric, summaryMetric} {
+		if _, ok := m.descs[descKey{name, other}]; ok {
+			m.warnOnce("not exporting %v as a %v: it is a %v already", name, typ, other)
+			return nil
+		}
+	}
+	d := prometheus.NewDesc(name, help, instanceLabelNames(extraLabels...), nil)
+	m.descs[descKey{name, typ}] = d
+	return d
+}
+
+// warnOnce logs a warning, unless it already did so. For things that would otherwise be logged on every poll. Caller
+// must hold m.mu
+func (m *zkMetrics) warnOnce(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if m.warned[msg] {
+		return
+	}
+	m.warned[msg] = true
+	log.Warn(msg)
+}
+
+// addInstance tells us about an instance before its first poll, so it counts as an ensemble member even if it never
+// answers. labels are the values of the targetLabelNames labels
+func (m *zkMetrics) addInstance(instance, ensemble string, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if state, ok := m.instances[instance]; ok {
+		state.ensemble, state.labels = ensemble, labels
+		return
+	}
+	m.instances[instance] = &instanceState{ensemble: ensemble, labels: labels}
+}
+
+// refresh converts the raw mntr / ruok output of one zk instance into samples, replacing whatever we had before. If
+// the poll failed (pollErr != nil) the instance is marked down and its samples dropped, as a partial result can't be
+// trusted.
+func (m *zkMetrics) refresh(instance string, updated map[string]string, pollErr error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.instances[instance]
+	if !ok {
+		state = &instanceState{}
+		m.instances[instance] = state
+	}
+
+	samples := make(map[string]zkSample)
+	state.samples = samples
+	state.hasZxid = false
+	state.up = pollErr == nil
+	if !state.up {
+		state.extra = nil
+		return
+	}
+	state.lastSuccess = time.Now()
+
+	// metric name -> the key exported under it. Keys can end up with the same name, e.g. zk_foo.bar and zk_foo_bar, and
+	// exporting both would fail the whole scrape, so the first one wins
+	claimed := make(map[string]string)
+	add := func(key, name, help string, typ metricType, s zkSample, extraLabels ...string) {
+		if other, ok := claimed[name]; ok {
+			m.warnOnce("[%v] not exporting %v: %v is exported as %v already", instance, key, other, name)
+			return
+		}
+		if s.desc = m.typedDesc(name, help, typ, extraLabels...); s.desc == nil {
+			return
+		}
+		claimed[name] = key
+		samples[key] = s
+	}
+
+	// the keys making up a summary are exported as part of it rather than on their own, unless we keep the legacy
+	// gauges. Even then the count and sum keys of the suffix form are skipped, as the summary's series have their names
+	skip := make(map[string]bool)
+	families := summaryFamilies(updated)
+	names := make([]string, 0, len(families))
+	for family := range families {
+		names = append(names, family)
+	}
+	sort.Strings(names)
+	for _, family := range names {
+		f := families[family]
+		name := sanitiseMetricName(family)
+		add(family, name, summaryHelpFor(family), summaryMetric, zkSample{summary: f})
+		claimed[name+"_count"], claimed[name+"_sum"] = family, family
+		for _, key := range f.keys {
+			if !*legacyGauges || key == family+"_count" || key == family+"_sum" {
+				skip[key] = true
+			}
+		}
+	}
+
+	// in order, so the same key wins every time
+	keys := make([]string, 0, len(updated))
+	for key := range updated {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, name := range keys {
+		value := updated[name]
+		if skip[name] {
+			continue
+		}
+		metricName, help := sanitiseMetricName(name), helpFor(name)
+		switch name {
+		// zkOK is a special case
+		case zkOK:
+			s := zkSample{}
+			if value == "imok" {
+				s.value = 1
+			}
+			add(name, metricName, help, gaugeMetric, s)
+
+		case zkServerState:
+			add(name, metricName, help, gaugeMetric, zkSample{value: float64(getState(value))})
+
+		case zkZxid:
+			zxid, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				log.Errorf("[%v] failed to parse zxid, value=%v", instance, value)
+				continue
+			}
+			state.zxid, state.hasZxid = zxid, true
+			add(name, metricName, help, gaugeMetric, zkSample{value: float64(zxid)})
+
+		case zkVersion:
+			// drop the git revision, so the label only changes on upgrades
+			version := strings.Split(value, "-")[0]
+			add(name, metricName, help, infoMetric, zkSample{value: 1, labels: []string{version}}, metricName)
+
+		// all other metrics get converted to float and exported according to their type; non numeric values can't be
+		// exported as a sample
+		default:
+			if metricTypes[name] == infoMetric {
+				// the value as a label named after the key
+				add(name, metricName, help, infoMetric, zkSample{value: 1, labels: []string{value}}, metricName)
+				continue
+			}
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				log.Debugf("[%v] skipping non numeric stat %v=%v", instance, name, value)
+				continue
+			}
+			if metricTypes[name] != counterMetric {
+				add(name, metricName, help, gaugeMetric, zkSample{value: f})
+				continue
+			}
+			add(name, counterName(name), help, counterMetric, zkSample{value: f, counter: true})
+			if *legacyGauges {
+				// the old name too, until dashboards have moved over. Not a valid mntr key, so it can't clash
+				add(name+" (gauge)", metricName, help, gaugeMetric, zkSample{value: f})
+			}
+		}
+	}
+}
+
+// refreshExtra replaces the samples an optional collector produced for an instance that is up. build runs with m.mu
+// held, so it can use m.desc / m.descWithHelp
+func (m *zkMetrics) refreshExtra(instance, collector string, build func() []zkSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.instances[instance]
+	if !ok || !state.up {
+		return
+	}
+	if state.extra == nil {
+		state.extra = make(map[string][]zkSample)
+	}
+	// descriptors are nil for names taken by another type, see typedDesc()
+	var samples []zkSample
+	for _, s := range build() {
+		if s.desc != nil {
+			samples = append(samples, s)
+		}
+	}
+	state.extra[collector] = samples
+}
+
+// forget drops everything we know about an instance, e.g. when it is no longer polled
+func (m *zkMetrics) forget(instance string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if state, ok := m.instances[instance]; ok {
+		m.pollingFailureCounter.DeleteLabelValues(state.metricLabels(instance)...)
+	}
+	delete(m.instances, instance)
+}
+
+// Describe sends no descriptors: metric names depend on what mntr reports, so zkMetrics is an unchecked collector
+func (m *zkMetrics) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect exports the latest samples of all zk instances
+func (m *zkMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.pollingFailureCounter.Collect(ch)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for instance, state := range m.instances {
+		up := 0.0
+		if state.up {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(m.upDesc, prometheus.GaugeValue, up, state.metricLabels(instance)...)
+
+		if !state.lastSuccess.IsZero() {
+			ch <- prometheus.MustNewConstMetric(m.lastSuccessfulPollDesc, prometheus.GaugeValue,
+				float64(state.lastSuccess.UnixNano())/1e9, state.metricLabels(instance)...)
+		}
+
+		for _, s := range state.samples {
+			ch <- s.metric(state.metricLabels(instance, s.labels...))
+		}
+		for _, samples := range state.extra {
+			for _, s := range samples {
+				ch <- s.metric(state.metricLabels(instance, s.labels...))
+			}
+		}
+	}
+
+	m.collectEnsembles(ch)
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	"strings"
+	"testing"
+)
+
+func TestSanitiseMetricName(t *testing.T) {
+	for key, want := range map[string]string{
+		"zk_avg_latency":                 "zk_avg_latency",
+		"zk_read_commit_proc_req_queued": "zk_read_commit_proc_req_queued",
+		"zk_p99.9-latency":               "zk_p99_9_latency",
+		"1st_key":                        "_1st_key",
+		"zk_élan":                        "zk__lan",
+	} {
+		assert.Equal(t, sanitiseMetricName(key), want)
+	}
+}
+
+func TestRefreshMetrics(t *testing.T) {
+	t.Run("known and unknown keys are exported", func(t *testing.T) {
+		m := newMetrics()
+		m.refresh("10.0.0.1:2181", map[string]string{
+			zkAvgLatency:                     "3",
+			zkServerState:                    "leader",
+			zkVersion:                        "3.6.2--1, built on 09/04/2020 12:44 GMT",
+			zkOK:                             "imok",
+			"zk_read_commit_proc_req_queued": "7",
+			"zk_uptime":                      "123456",
+			"zk_some_string":                 "not a number",
+		}, nil)
+
+		want := `
+# HELP zk_avg_latency Average Latency for ZooKeeper network requests
+# TYPE zk_avg_latency gauge
+zk_avg_latency{zk_instance="10.0.0.1:2181"} 3
+# HELP zk_ok Is ZooKeeper currently OK
+# TYPE zk_ok gauge
+zk_ok{zk_instance="10.0.0.1:2181"} 1
+# HELP zk_read_commit_proc_req_queued Value of zk_read_commit_proc_req_queued as reported by the mntr command
+# TYPE zk_read_commit_proc_req_queued gauge
+zk_read_commit_proc_req_queued{zk_instance="10.0.0.1:2181"} 7
+# HELP zk_server_state Current state of the zk instance: 1 = follower, 2 = leader, 3 = standalone, -1 if unknown
+# TYPE zk_server_state gauge
+zk_server_state{zk_instance="10.0.0.1:2181"} 2
+# HELP zk_uptime Value of zk_uptime as reported by the mntr command
+# TYPE zk_uptime gauge
+zk_uptime{zk_instance="10.0.0.1:2181"} 123456
+# HELP zk_version Zookeeper version
+# TYPE zk_version gauge
+zk_version{zk_instance="10.0.0.1:2181",zk_version="3.6.2"} 1
+`
+		err := testutil.CollectAndCompare(m, strings.NewReader(want),
+			"zk_avg_latency", "zk_ok", "zk_read_commit_proc_req_queued", "zk_server_state", "zk_uptime", "zk_version",
+			"zk_some_string")
+		assert.NilError(t, err)
+	})
+
+	t.Run("upgrade replaces zk_version label", func(t *testing.T) {
+		m := newMetrics()
+		m.refresh("10.0.0.1:2181", map[string]string{zkVersion: "3.5.8-f439ca583e70862c3068a1f2a7d4d068eec33315"}, nil)
+		m.refresh("10.0.0.1:2181", map[string]string{zkVersion: "3.6.2--803c7f1a12f85978cb049af5e4ef23bd8b688715"}, nil)
+
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(m)
+		mfs, err := reg.Gather()
+		assert.NilError(t, err)
+		for _, mf := range mfs {
+			if mf.GetName() == zkVersion {
+				assert.Equal(t, len(mf.GetMetric()), 1)
+				assert.Equal(t, mf.GetMetric()[0].GetLabel()[1].GetValue(), "3.6.2")
+			}
+		}
+	})
+
+	t.Run("keys that end up with the same name are skipped", func(t *testing.T) {
+		m := newMetrics()
+		m.refresh("10.0.0.1:2181", map[string]string{
+			"zk_foo.bar":   "1",
+			"zk_foo_bar":   "2",
+			"zk_foo_total": "3",
+			// zk_packets_received_total too, as a counter
+			"zk_packets_received_total": "4",
+			zkPacketsReceived:           "5",
+		}, nil)
+		// another type than the name has already
+		m.refresh("10.0.0.2:2181", map[string]string{"zk_foo": "6", zkDigestMismatches: "7", "zk_digest_mismatches_total": "8"}, nil)
+		m.refresh("10.0.0.3:2181", map[string]string{"zk_foo_total": "9"}, nil)
+		m.refresh("10.0.0.4:2181", map[string]string{zkVersion: "3.6.2", "zk_cnt_foo": "1", "zk_sum_foo": "1"}, nil)
+
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(m)
+		_, err := reg.Gather()
+		assert.NilError(t, err)
+
+		// the first key in sort order wins
+		want := `
+# HELP zk_foo_bar Value of zk_foo.bar as reported by the mntr command
+# TYPE zk_foo_bar gauge
+zk_foo_bar{zk_instance="10.0.0.1:2181"} 1
+# HELP zk_packets_received_total Number of network packets received by the ZooKeeper instance.
+# TYPE zk_packets_received_total counter
+zk_packets_received_total{zk_instance="10.0.0.1:2181"} 5
+`
+		assert.NilError(t, testutil.CollectAndCompare(m, strings.NewReader(want), "zk_foo_bar", "zk_packets_received_total"))
+		assert.Equal(t, testutil.CollectAndCount(m, "zk_foo_total"), 2)
+		// zk_foo is a summary of 10.0.0.4 as well, but a gauge already
+		assert.Equal(t, testutil.CollectAndCount(m, "zk_foo"), 1)
+	})
+}
+
+func TestCounters(t *testing.T) {
+	stats := map[string]string{zkPacketsReceived: "1234", zkFsyncThresholdExceeded: "2", zkWatchCount: "5"}
+
+	t.Run("counters get a _total suffix", func(t *testing.T) {
+		m := newMetrics()
+		m.refresh("10.0.0.1:2181", stats, nil)
+
+		want := `
+# HELP zk_fsync_threshold_exceed_total Number of times File sync exceeded fsyncWarningThresholdMS
+# TYPE zk_fsync_threshold_exceed_total counter
+zk_fsync_threshold_exceed_total{zk_instance="10.0.0.1:2181"} 2
+# HELP zk_packets_received_total Number of network packets received by the ZooKeeper instance.
+# TYPE zk_packets_received_total counter
+zk_packets_received_total{zk_instance="10.0.0.1:2181"} 1234
+# HELP zk_watch_count Watch count
+# TYPE zk_watch_count gauge
+zk_watch_count{zk_instance="10.0.0.1:2181"} 5
+`
+		err := testutil.CollectAndCompare(m, strings.NewReader(want),
+			"zk_fsync_threshold_exceed_total", "zk_packets_received_total", "zk_watch_count",
+			"zk_fsync_threshold_exceed_count", "zk_packets_received")
+		assert.NilError(t, err)
+	})
+
+	t.Run("legacy gauges", func(t *testing.T) {
+		*legacyGauges = true
+		defer func() { *legacyGauges = false }()
+		m := newMetrics()
+		m.refresh("10.0.0.1:2181", stats, nil)
+
+		want := `
+# HELP zk_packets_received Number of network packets received by the ZooKeeper instance.
+# TYPE zk_packets_received gauge
+zk_packets_received{zk_instance="10.0.0.1:2181"} 1234
+# HELP zk_packets_received_total Number of network packets received by the ZooKeeper instance.
+# TYPE zk_packets_received_total counter
+zk_packets_received_total{zk_instance="10.0.0.1:2181"} 1234
+`
+		err := testutil.CollectAndCompare(m, strings.NewReader(want), "zk_packets_received", "zk_packets_received_total")
+		assert.NilError(t, err)
+	})
+}
+
+func TestCounterName(t *testing.T) {
+	for key, want := range map[string]string{
+		zkPacketsSent:            "zk_packets_sent_total",
+		zkFsyncThresholdExceeded: "zk_fsync_threshold_exceed_total",
+		zkBytesReceived:          "zk_bytes_received_total",
+	} {
+		assert.Equal(t, counterName(key), want)
+	}
+}
+
+func TestStaleSeries(t *testing.T) {
+	m := newMetrics()
+	m.refresh("10.0.0.1:2181", map[string]string{zkAvgLatency: "3", zkOK: "imok"}, nil)
+	m.refresh("10.0.0.1:2181", map[string]string{}, errors.New("connection refused"))
+
+	want := `
+# HELP up Whether the zk instance answered the last poll
+# TYPE up gauge
+up{zk_instance="10.0.0.1:2181"} 0
+`
+	assert.NilError(t, testutil.CollectAndCompare(m, strings.NewReader(want), "up", "zk_avg_latency", "zk_ok"))
+	assert.Equal(t, testutil.CollectAndCount(m, lastSuccessfulPoll), 1)
+
+	m.forget("10.0.0.1:2181")
+	assert.Equal(t, testutil.CollectAndCount(m), 0)
+}
@@ -1,18 +1,17 @@
 package main
 
 import (
-	"strconv"
-	"strings"
+	"context"
 	"time"
 )
 
 type zkPoller struct {
 	interval time.Duration
-	metrics  zkMetrics
-	zkServer zkServer
+	metrics  *zkMetrics
+	zkServer *zkServer
 }
 
-func newPoller(interval time.Duration, metrics zkMetrics, zkServer zkServer) *zkPoller {
+func newPoller(interval time.Duration, metrics *zkMetrics, zkServer *zkServer) *zkPoller {
 	return &zkPoller{
 		interval: interval,
 		metrics:  metrics,
@@ -20,64 +19,65 @@ func newPoller(interval time.Duration, metrics zkMetrics, zkServer zkServer) *zk
 	}
 }
 
-func (p *zkPoller) pollForMetrics() {
+// pollForMetrics polls the server every p.interval until ctx is cancelled
+func (p *zkPoller) pollForMetrics(ctx context.Context) {
 	// Initialise to counter to 0
-	p.metrics.pollingFailureCounter.WithLabelValues(p.zkServer.ipPort).Add(0)
+	p.metrics.pollingFailureCounter.WithLabelValues(p.zkServer.metricLabels()...).Add(0)
+	p.metrics.addInstance(p.zkServer.ipPort, p.zkServer.ensemble, p.zkServer.labels...)
 	for {
 		expirationTime := time.Now().Add(p.interval)
-		m, err := p.zkServer.getStats()
+		m, err := p.zkServer.getStats(ctx)
+		if ctx.Err() != nil {
+			// stopped mid poll, the error is ours rather than ZK's
+			return
+		}
 		if err != nil {
 			log.Errorf("[%v] failed to get stats: %v", p.zkServer.ipPort, err)
-			p.metrics.pollingFailureCounter.WithLabelValues(p.zkServer.ipPort).Inc()
+			p.metrics.pollingFailureCounter.WithLabelValues(p.zkServer.metricLabels()...).Inc()
 		}
 
-		p.refreshMetrics(m)
+		p.refreshMetrics(m, err)
+		if err == nil {
+			pollOptional(ctx, p.zkServer, p.metrics)
+		}
 
 		// Instead of sleeping for a further p.interval time, calculate for long we've already spent polling, and sleep
 		// the difference
-		<-time.After(expirationTime.Sub(time.Now()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(expirationTime.Sub(time.Now())):
+		}
 	}
 }
 
-func (p *zkPoller) refreshMetrics(updated map[string]string) {
-	for name, value := range updated {
-		metric, ok := p.metrics.gauges[name]
-
-		if !ok {
-			log.Errorf("[%v] stat=%v not defined in metrics.go\n", p.zkServer.ipPort, name)
-			continue
-		}
-
-		// zkOK is a special case
-		if name == zkOK {
-			switch value {
-			case "imok":
-				metric.WithLabelValues(p.zkServer.ipPort).Set(1)
-			default:
-				metric.WithLabelValues(p.zkServer.ipPort).Set(0)
-			}
-			continue
-		}
-
-		// zk_version is also a special case
-		if name == zkVersion {
-			versionSplits := strings.Split(value, "-")
-			metric.WithLabelValues(p.zkServer.ipPort, versionSplits[0]).Set(1)
-			continue
-		}
-
-		if name == zkServerState {
-			state := getState(value)
-			metric.WithLabelValues(p.zkServer.ipPort).Set(float64(state))
-			continue
-		}
+// hands the latest stats over to the metrics collector; a failed poll marks the instance down
+func (p *zkPoller) refreshMetrics(updated map[string]string, err error) {
+	p.metrics.refresh(p.zkServer.ipPort, updated, err)
+}
 
-		// all other metrics get converted to float and used as is
-		f, err := strconv.ParseFloat(value, 64)
-		if err != nil {
-			log.Errorf("[%v] failed to convert string to float, value=%v", p.zkServer.ipPort, value)
-		}
+// pollOptional runs the optional collectors against a server that just answered a poll. Their failures are logged, but
+// don't count as polling failures
+func pollOptional(ctx context.Context, zk *zkServer, metrics *zkMetrics) {
+	if *infoPollInterval > 0 {
+		pollInfo(ctx, zk, metrics, time.Duration(*infoPollInterval)*time.Second)
+	}
+	pollTLS(zk, metrics)
 
-		metric.WithLabelValues(p.zkServer.ipPort).Set(f)
+	// cons, the watch commands, the client probe and the tree crawl need the client port
+	if zk.adminURL != "" {
+		return
+	}
+	if zk.collectors[collectorClientProbe] {
+		pollClientProbe(ctx, zk, metrics)
+	}
+	if zk.collectors[collectorCons] {
+		pollCons(ctx, zk, metrics)
+	}
+	if zk.collectors[collectorWchs] || zk.collectors[collectorWchc] || zk.collectors[collectorWchp] {
+		pollWatches(ctx, zk, metrics)
+	}
+	if zk.collectors[collectorTree] {
+		pollTree(zk, metrics, time.Duration(*treeInterval)*time.Second)
 	}
 }
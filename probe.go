@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	probeSuccess         = "probe_success"
+	probeDurationSeconds = "probe_duration_seconds"
+
+	// header prometheus sets on every scrape
+	scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+)
+
+// a probe module decides which commands are sent to the target
+type probeModule func(ctx context.Context, zk *zkServer) (map[string]string, error)
+
+var probeModules = map[string]probeModule{
+	// mntr + ruok, same as the background pollers
+	"default": func(ctx context.Context, zk *zkServer) (map[string]string, error) {
+		return zk.getStats(ctx)
+	},
+	// ruok only, for a cheap liveness check
+	"ruok": func(ctx context.Context, zk *zkServer) (map[string]string, error) {
+		isOK, err := zk.getOKStatus(ctx)
+		return map[string]string{zkOK: isOK}, err
+	},
+}
+
+// scrapeTimeout returns the time left for a scrape, according to the header prometheus sends. Like blackbox_exporter,
+// we knock a little off so we can still answer before prometheus gives up on us. ok is false if the header is absent.
+func scrapeTimeout(r *http.Request) (timeout time.Duration, ok bool, err error) {
+	v := r.Header.Get(scrapeTimeoutHeader)
+	if v == "" {
+		return 0, false, nil
+	}
+
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to parse timeout from %s header: %v", scrapeTimeoutHeader, err)
+	}
+	if seconds > 1 {
+		seconds -= 0.5
+	}
+	return time.Duration(seconds * float64(time.Second)), true, nil
+}
+
+// probeHandler serves /probe?target=host:port&module=default, polling target synchronously and returning a fresh
+// registry holding only its metrics
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	target := params.Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	moduleName := params.Get("module")
+	if moduleName == "" {
+		moduleName = "default"
+	}
+	module, ok := probeModules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	timeout, ok, err := scrapeTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	successGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: prependNamespace(probeSuccess),
+		Help: "Whether the probe of the zk instance succeeded",
+	})
+	durationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: prependNamespace(probeDurationSeconds),
+		Help: "How long the probe of the zk instance took to complete in seconds",
+	})
+
+	start := time.Now()
+	stats, err := module(ctx, newZKServer(target))
+	durationGauge.Set(time.Since(start).Seconds())
+	if err != nil {
+		log.Errorf("[%v] probe with module %v failed: %v", target, moduleName, err)
+	} else {
+		successGauge.Set(1)
+	}
+
+	metrics := newMetrics()
+	metrics.refresh(target, stats, err)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics, successGauge, durationGauge)
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
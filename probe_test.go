@@ -0,0 +1,78 @@
+package main
+
+import (
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeHandler(t *testing.T) {
+	defer func(timeout int, deadline float64) { *zkTimeout, *zkRWDeadLine = timeout, deadline }(*zkTimeout, *zkRWDeadLine)
+	*zkTimeout, *zkRWDeadLine = 1, 1
+
+	t.Run("missing target", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		probeHandler(rr, httptest.NewRequest("GET", "/probe", nil))
+		assert.Equal(t, rr.Code, http.StatusBadRequest)
+	})
+
+	t.Run("unknown module", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		probeHandler(rr, httptest.NewRequest("GET", "/probe?target=127.0.0.1:2181&module=bananas", nil))
+		assert.Equal(t, rr.Code, http.StatusBadRequest)
+	})
+
+	t.Run("default module", func(t *testing.T) {
+		f, err := newFakeZK("127.0.0.1:0")
+		assert.NilError(t, err)
+		defer f.close()
+
+		rr := httptest.NewRecorder()
+		probeHandler(rr, httptest.NewRequest("GET", "/probe?target="+f.addr(), nil))
+		assert.Equal(t, rr.Code, http.StatusOK)
+		body := rr.Body.String()
+		assert.Assert(t, strings.Contains(body, "\nprobe_success 1\n"), body)
+		instance := `{zk_instance="` + f.addr() + `"}`
+		for _, series := range []string{
+			"up" + instance + " 1", "zk_ok" + instance + " 1", "zk_server_state" + instance + " 2",
+			"zk_znode_count" + instance + " 5",
+		} {
+			assert.Assert(t, strings.Contains(body, "\n"+series+"\n"), "%v missing from\n%v", series, body)
+		}
+	})
+
+	t.Run("ruok module only sends ruok", func(t *testing.T) {
+		f, err := newFakeZK("127.0.0.1:0")
+		assert.NilError(t, err)
+		defer f.close()
+
+		rr := httptest.NewRecorder()
+		probeHandler(rr, httptest.NewRequest("GET", "/probe?target="+f.addr()+"&module=ruok", nil))
+		assert.Equal(t, rr.Code, http.StatusOK)
+		assert.Assert(t, strings.Contains(rr.Body.String(), "\nprobe_success 1\n"), rr.Body.String())
+		assert.Equal(t, f.requestCount(okCMD), 1)
+		for _, cmd := range []string{monitorCMD, srvrCMD, statCMD} {
+			assert.Equal(t, f.requestCount(cmd), 0, cmd)
+		}
+	})
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	req := httptest.NewRequest("GET", "/probe", nil)
+	_, ok, err := scrapeTimeout(req)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok, "no header should mean no timeout")
+
+	req.Header.Set(scrapeTimeoutHeader, "10")
+	timeout, ok, err := scrapeTimeout(req)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.Equal(t, timeout, 9500*time.Millisecond)
+
+	req.Header.Set(scrapeTimeoutHeader, "soon")
+	_, _, err = scrapeTimeout(req)
+	assert.Assert(t, err != nil, "garbage header should fail to parse")
+}
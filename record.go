@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// the commands record captures: every four letter word the exporter sends, bar stat, which it only sends if srvr isn't
+// whitelisted
+var recordedCommands = []string{
+	monitorCMD, okCMD, srvrCMD, enviCMD, confCMD, consCMD, wchsCMD, wchcCMD, wchpCMD,
+}
+
+// commandTransport sends a four letter word to a server, and returns its raw response
+type commandTransport interface {
+	sendCommand(ctx context.Context, cmd string) ([]byte, error)
+}
+
+// replayTransport answers four letter words with the responses record captured in dir, one file per command. Commands
+// that weren't captured get no answer, like ZooKeeper gives to commands it doesn't know.
+type replayTransport struct {
+	dir string
+}
+
+func (r replayTransport) sendCommand(ctx context.Context, cmd string) ([]byte, error) {
+	byts, err := ioutil.ReadFile(filepath.Join(r.dir, cmd))
+	if os.IsNotExist(err) {
+		return []byte{}, nil
+	}
+	return byts, err
+}
+
+// runRecord is the record command: it sends every recordedCommands to a live server, and writes the raw responses to
+// the output directory for replayTransport. Commands that fail are skipped, so their fixtures are missing
+func runRecord() error {
+	if err := os.MkdirAll(*recordOutput, 0755); err != nil {
+		return err
+	}
+
+	zk := newZKServer(*recordTarget)
+	if zk.adminURL != "" {
+		return fmt.Errorf("%v: only four letter words can be recorded, not the AdminServer", *recordTarget)
+	}
+	for _, cmd := range recordedCommands {
+		byts, err := zk.sendCommand(context.Background(), cmd)
+		if err != nil {
+			log.Warnf("[%v] skipping %v: %v", zk.ipPort, cmd, err)
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(*recordOutput, cmd), byts, 0644); err != nil {
+			return err
+		}
+		log.Infof("[%v] recorded %v: %d bytes", zk.ipPort, cmd, len(byts))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"gotest.tools/assert"
+	"gotest.tools/golden"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestGoldenFixtures polls responses recorded from every ZooKeeper version we support, and compares the metrics with
+// the golden files next to them. Run with -test.update-golden to regenerate those after a deliberate change.
+func TestGoldenFixtures(t *testing.T) {
+	defer func(interval, depth int) { *infoPollInterval, *wchPathDepth = interval, depth }(*infoPollInterval, *wchPathDepth)
+	*infoPollInterval, *wchPathDepth = 60, 2
+
+	versions, err := ioutil.ReadDir(filepath.Join("testdata", "fixtures"))
+	assert.NilError(t, err)
+
+	for _, v := range versions {
+		version := v.Name()
+		t.Run(version, func(t *testing.T) {
+			zk := newZKServer("zk-" + version + ":2181")
+			zk.transport = replayTransport{dir: filepath.Join("testdata", "fixtures", version)}
+			// every collector that only sends four letter words, so every fixture is replayed
+			zk.collectors = collectorSet{
+				collectorZxid: true, collectorCons: true, collectorWchs: true, collectorWchc: true, collectorWchp: true,
+			}
+			ctx := context.Background()
+			metrics := newMetrics()
+
+			// as the poller does it
+			stats, err := zk.getStats(ctx)
+			metrics.refresh(zk.ipPort, stats, err)
+			if err == nil {
+				pollOptional(ctx, zk, metrics)
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(metrics)
+			families, err := reg.Gather()
+			assert.NilError(t, err)
+			reserved := reservedLabels()
+			var out bytes.Buffer
+			for _, mf := range families {
+				for _, m := range mf.GetMetric() {
+					for _, l := range m.GetLabel() {
+						assert.Assert(t, reserved[l.GetName()], "%v: label %q isn't reserved", mf.GetName(), l.GetName())
+					}
+				}
+				if mf.GetName() == prependNamespace(lastSuccessfulPoll) {
+					// changes on every run
+					continue
+				}
+				_, err := expfmt.MetricFamilyToText(&out, mf)
+				assert.NilError(t, err)
+			}
+			golden.Assert(t, out.String(), filepath.Join("fixtures", version, "metrics.golden"))
+		})
+	}
+}
+
+func TestRecord(t *testing.T) {
+	defer func(timeout int, deadline float64) { *zkTimeout, *zkRWDeadLine = timeout, deadline }(*zkTimeout, *zkRWDeadLine)
+	*zkTimeout, *zkRWDeadLine = 1, 1
+	f, err := newFakeZK("127.0.0.1:0")
+	assert.NilError(t, err)
+	defer f.close()
+
+	dir, err := ioutil.TempDir("", "zookeeper_exporter")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { *recordTarget, *recordOutput = "", "" }()
+	*recordTarget, *recordOutput = f.addr(), dir
+
+	assert.NilError(t, runRecord())
+	for _, cmd := range recordedCommands {
+		_, err := os.Stat(filepath.Join(dir, cmd))
+		assert.NilError(t, err, cmd)
+	}
+
+	// replaying gives what the server answered
+	replay := newZKServer("zk:2181")
+	replay.transport = replayTransport{dir: dir}
+	stats, err := replay.getStats(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, stats[zkServerState], "leader")
+	assert.Equal(t, stats[zkOK], "imok")
+
+	byts, err := replay.sendCommand(context.Background(), "xxxx")
+	assert.NilError(t, err)
+	assert.Equal(t, len(byts), 0)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// exit codes of the serve command
+const (
+	exitOK = 0
+	// the HTTP server failed, e.g. it couldn't listen
+	exitServeFailed = 1
+	// we were asked to stop, but couldn't do so cleanly: requests were cut off, or we couldn't deregister from consul
+	exitShutdownFailed = 2
+)
+
+// serveUntilSignalled serves on ln until the server fails or a signal arrives on stop, then shuts down: it deregisters
+// from consul (sr may be nil) so nobody new gets pointed at us, gives in flight requests up to timeout to finish, and
+// stops the pollers and canaries. Returns the exit code.
+func serveUntilSignalled(srv *http.Server, ln net.Listener, stop <-chan os.Signal, targets *targetManager, sr *ServiceRegistrar, timeout time.Duration) int {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	code := exitOK
+	select {
+	case err := <-serveErr:
+		log.Errorf("http server failed: %v", err)
+		code = exitServeFailed
+	case sig := <-stop:
+		log.Infof("received %v, shutting down", sig)
+	}
+
+	if sr != nil {
+		if err := sr.deRegister(); err != nil {
+			log.Errorf("failed to deregister with consul: %v", err)
+			if code == exitOK {
+				code = exitShutdownFailed
+			}
+		} else {
+			log.Infof("deregistered service %v from consul", sr.Name)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Errorf("failed to shut down the http server: %v", err)
+		if code == exitOK {
+			code = exitShutdownFailed
+		}
+	}
+
+	targets.stopAll()
+	log.Infof("stopped")
+	return code
+}
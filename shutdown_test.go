@@ -0,0 +1,88 @@
+package main
+
+import (
+	"gotest.tools/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeUntilSignalled(t *testing.T) {
+	// starts serving handler, returning the listen address and a channel with the exit code
+	serve := func(t *testing.T, handler http.Handler, stop chan os.Signal, targets *targetManager, sr *ServiceRegistrar) (string, chan int) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NilError(t, err)
+		code := make(chan int, 1)
+		go func() {
+			code <- serveUntilSignalled(&http.Server{Handler: handler}, ln, stop, targets, sr, time.Second)
+		}()
+		return ln.Addr().String(), code
+	}
+
+	t.Run("drains requests, deregisters and stops pollers", func(t *testing.T) {
+		c := newFakeConsul()
+		defer c.Close()
+		sr := c.registrar(t, "zookeeper_exporter")
+
+		defer func(timeout int, deadline float64, interval int) {
+			*zkTimeout, *zkRWDeadLine, *pollInterval = timeout, deadline, interval
+		}(*zkTimeout, *zkRWDeadLine, *pollInterval)
+		*zkTimeout, *zkRWDeadLine, *pollInterval = 1, 1, 30
+		metrics := newMetrics()
+		targets := newTargetManager(metrics)
+		targets.apply([]*zkServer{newZKServer("127.0.0.1:1")})
+
+		started := make(chan struct{})
+		slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			_, _ = w.Write([]byte("done"))
+		})
+		stop := make(chan os.Signal, 1)
+		addr, code := serve(t, slow, stop, targets, sr)
+
+		body := make(chan string, 1)
+		go func() {
+			resp, err := http.Get("http://" + addr)
+			if err != nil {
+				body <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			byts, _ := ioutil.ReadAll(resp.Body)
+			body <- string(byts)
+		}()
+		<-started
+		stop <- syscall.SIGTERM
+
+		assert.Equal(t, <-code, exitOK)
+		assert.Equal(t, <-body, "done")
+		assert.Equal(t, c.received()[len(c.received())-1], "PUT /v1/agent/service/deregister/zookeeper_exporter")
+		assert.Equal(t, len(targets.pollers), 0)
+	})
+
+	t.Run("failed deregistration", func(t *testing.T) {
+		c := newFakeConsul()
+		defer c.Close()
+		c.deregisterStatus = http.StatusInternalServerError
+		sr := c.registrar(t, "zookeeper_exporter")
+
+		stop := make(chan os.Signal, 1)
+		_, code := serve(t, http.NotFoundHandler(), stop, newTargetManager(nil), sr)
+		stop <- syscall.SIGINT
+		assert.Equal(t, <-code, exitShutdownFailed)
+	})
+
+	t.Run("server failure", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NilError(t, err)
+		assert.NilError(t, ln.Close())
+
+		code := serveUntilSignalled(&http.Server{}, ln, make(chan os.Signal), newTargetManager(nil), nil, time.Second)
+		assert.Equal(t, code, exitServeFailed)
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+)
+
+const (
+	statCMD = "stat"
+
+	notServingRequests = "This ZooKeeper instance is not currently serving requests"
+)
+
+// maps the simple "Key: value" lines of srvr / stat output to the mntr key reporting the same thing
+var srvrKeys = map[string]string{
+	"Zookeeper version": zkVersion,
+	"Received":          zkPacketsReceived,
+	"Sent":              zkPacketsSent,
+	"Connections":       zkNumAliveConnections,
+	"Outstanding":       zkOutstandingRequests,
+	"Mode":              zkServerState,
+	"Node count":        zkZnodeCount,
+}
+
+// getSrvr runs srvr, falling back to stat if srvr isn't whitelisted. Both return the same summary, stat just adds
+// a list of clients which we ignore
+func (zk *zkServer) getSrvr(ctx context.Context) (map[string]string, error) {
+	byts, err := zk.sendWhitelistedCommand(ctx, srvrCMD)
+	if err == errNotWhitelisted {
+		log.Debugf("[%v] srvr not whitelisted, trying stat", zk.ipPort)
+		byts, err = zk.sendWhitelistedCommand(ctx, statCMD)
+	}
+	if err != nil {
+		return make(map[string]string), err
+	}
+
+	stats := parseSrvr(byts)
+	if len(stats) == 0 {
+		log.Warnf("[%v] is up but not currently serving requests", zk.ipPort)
+	}
+	return stats, nil
+}
+
+// parseSrvr converts srvr / stat output to the mntr keys reporting the same thing, plus zk_zxid, zk_epoch and
+// zk_last_zxid_counter
+func parseSrvr(byts []byte) map[string]string {
+	stats := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(byts))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, notServingRequests) {
+			return stats
+		}
+
+		splits := strings.SplitN(line, ": ", 2)
+		if len(splits) != 2 {
+			// blank lines, "Clients:" and the client list of stat
+			continue
+		}
+		key, value := splits[0], strings.TrimSpace(splits[1])
+
+		if mntrKey, ok := srvrKeys[key]; ok {
+			stats[mntrKey] = value
+			continue
+		}
+
+		switch key {
+		case "Latency min/avg/max":
+			latencies := strings.Split(value, "/")
+			if len(latencies) != 3 {
+				continue
+			}
+			stats[zkMinLatency] = latencies[0]
+			stats[zkAvgLatency] = latencies[1]
+			stats[zkMaxLatency] = latencies[2]
+
+		case "Zxid":
+			zxid, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 64)
+			if err != nil {
+				log.Warnf("failed to parse zxid %v: %v", value, err)
+				continue
+			}
+			setZxidStats(stats, zxid)
+		}
+	}
+	return stats
+}
+
+// setZxidStats adds zk_zxid, zk_epoch and zk_last_zxid_counter to stats. The high 32 bits of a zxid are the epoch, the
+// low 32 bits count transactions within the epoch
+func setZxidStats(stats map[string]string, zxid uint64) {
+	stats[zkZxid] = strconv.FormatUint(zxid, 10)
+	stats[zkEpoch] = strconv.FormatUint(zxid>>32, 10)
+	stats[zkLastZxidCounter] = strconv.FormatUint(zxid&0xffffffff, 10)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"gotest.tools/assert"
+	"testing"
+)
+
+func TestParseSrvr(t *testing.T) {
+	t.Run("srvr", func(t *testing.T) {
+		out := `Zookeeper version: 3.4.14-4c25d480e66aadd371de8bd2fd8da255ac140bcf, built on 03/06/2019 16:18 GMT
+Latency min/avg/max: 0/1/12
+Received: 1234
+Sent: 1233
+Connections: 3
+Outstanding: 0
+Zxid: 0x300000002
+Mode: leader
+Node count: 42
+`
+		assert.DeepEqual(t, parseSrvr([]byte(out)), map[string]string{
+			zkVersion:             "3.4.14-4c25d480e66aadd371de8bd2fd8da255ac140bcf, built on 03/06/2019 16:18 GMT",
+			zkMinLatency:          "0",
+			zkAvgLatency:          "1",
+			zkMaxLatency:          "12",
+			zkPacketsReceived:     "1234",
+			zkPacketsSent:         "1233",
+			zkNumAliveConnections: "3",
+			zkOutstandingRequests: "0",
+			zkZxid:                "12884901890",
+			zkEpoch:               "3",
+			zkLastZxidCounter:     "2",
+			zkServerState:         "leader",
+			zkZnodeCount:          "42",
+		})
+	})
+
+	t.Run("stat ignores the client list", func(t *testing.T) {
+		out := `Zookeeper version: 3.5.9-83df9301aa5c2a5d284a9940177808c01bc35cef, built on 01/06/2021 20:03 GMT
+Clients:
+ /10.0.0.5:51234[1](queued=0,recved=10,sent=10)
+ /127.0.0.1:54132[0](queued=0,recved=1,sent=0)
+
+Latency min/avg/max: 0/0/0
+Received: 11
+Sent: 10
+Connections: 2
+Outstanding: 0
+Zxid: 0x0
+Mode: standalone
+Node count: 5
+`
+		stats := parseSrvr([]byte(out))
+		assert.Equal(t, stats[zkNumAliveConnections], "2")
+		assert.Equal(t, stats[zkServerState], "standalone")
+		assert.Equal(t, stats[zkZxid], "0")
+		assert.Equal(t, len(stats), 13)
+	})
+
+	t.Run("not serving requests", func(t *testing.T) {
+		assert.Equal(t, len(parseSrvr([]byte(notServingRequests+"\n"))), 0)
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/common/model"
+	"strconv"
+	"strings"
+)
+
+// ZooKeeper 3.6+ reports its summary metrics as separate mntr keys, either with the statistic as a prefix
+// (zk_cnt_readlatency, zk_sum_readlatency, zk_p99_readlatency, ...) or as a suffix (zk_read_latency_count,
+// zk_read_latency_sum, zk_read_latency_p99, ...). We put them back together into prometheus summaries, so they can be
+// aggregated across servers.
+
+// the label prometheus adds to the quantiles of a summary, which we never pass ourselves
+var _ = exporterLabels(model.QuantileLabel)
+
+// the quantile each percentile statistic stands for
+var summaryQuantiles = map[string]float64{
+	"p50":  0.5,
+	"p95":  0.95,
+	"p99":  0.99,
+	"p999": 0.999,
+}
+
+// the statistics making up a summary, by how they are called as a prefix and as a suffix
+var (
+	summaryPrefixes = map[string]string{"cnt": "count", "sum": "sum", "p50": "p50", "p95": "p95", "p99": "p99", "p999": "p999"}
+	summarySuffixes = map[string]string{"count": "count", "sum": "sum", "p50": "p50", "p95": "p95", "p99": "p99", "p999": "p999"}
+)
+
+// summaryFamily is one summary as reported by mntr
+type summaryFamily struct {
+	count     uint64
+	sum       float64
+	quantiles map[float64]float64
+	// the mntr keys it was built from
+	keys []string
+}
+
+// splitSummaryKey returns the summary an mntr key belongs to, and which of its statistics it is
+func splitSummaryKey(key string) (family, stat string, ok bool) {
+	if rest := strings.TrimPrefix(key, "zk_"); rest != key {
+		for prefix, stat := range summaryPrefixes {
+			if name := strings.TrimPrefix(rest, prefix+"_"); name != rest && name != "" {
+				return "zk_" + name, stat, true
+			}
+		}
+	}
+	for suffix, stat := range summarySuffixes {
+		if name := strings.TrimSuffix(key, "_"+suffix); name != key && name != "" {
+			return name, stat, true
+		}
+	}
+	return "", "", false
+}
+
+// summaryFamilies finds the summaries among the mntr stats. Only keys that come with both a count and a sum make up a
+// summary: the others, e.g. zk_digest_mismatches_count on its own, are left alone. Summaries with a count or sum that
+// isn't a number are skipped, as are percentiles that aren't numbers.
+func summaryFamilies(stats map[string]string) map[string]*summaryFamily {
+	type candidate struct {
+		stats map[string]string
+		keys  map[string]string
+	}
+	candidates := make(map[string]*candidate)
+	for key, value := range stats {
+		family, stat, ok := splitSummaryKey(key)
+		if !ok {
+			continue
+		}
+		c, ok := candidates[family]
+		if !ok {
+			c = &candidate{stats: make(map[string]string), keys: make(map[string]string)}
+			candidates[family] = c
+		}
+		c.stats[stat], c.keys[stat] = value, key
+	}
+
+	families := make(map[string]*summaryFamily)
+	for name, c := range candidates {
+		count, countOK := c.stats["count"]
+		sum, sumOK := c.stats["sum"]
+		if !countOK || !sumOK {
+			continue
+		}
+		if _, ok := stats[name]; ok {
+			// the name is taken
+			continue
+		}
+		f := &summaryFamily{quantiles: make(map[float64]float64)}
+		var err error
+		if f.count, err = strconv.ParseUint(count, 10, 64); err != nil {
+			continue
+		}
+		if f.sum, err = strconv.ParseFloat(sum, 64); err != nil {
+			continue
+		}
+		f.keys = append(f.keys, c.keys["count"], c.keys["sum"])
+		for stat, q := range summaryQuantiles {
+			value, ok := c.stats[stat]
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			f.quantiles[q] = v
+			f.keys = append(f.keys, c.keys[stat])
+		}
+		families[name] = f
+	}
+	return families
+}
+
+// returns the curated help text for known summaries, or a generic one for anything else
+func summaryHelpFor(family string) string {
+	if help, ok := knownMetrics[family]; ok {
+		return help
+	}
+	return fmt.Sprintf("Summary of %s as reported by the mntr command", family)
+}
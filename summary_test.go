@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	"strings"
+	"testing"
+)
+
+func TestSplitSummaryKey(t *testing.T) {
+	for _, tc := range []struct {
+		key, family, stat string
+		ok                bool
+	}{
+		{"zk_cnt_readlatency", "zk_readlatency", "count", true},
+		{"zk_sum_readlatency", "zk_readlatency", "sum", true},
+		{"zk_p999_readlatency", "zk_readlatency", "p999", true},
+		{"zk_read_latency_count", "zk_read_latency", "count", true},
+		{"zk_read_latency_p99", "zk_read_latency", "p99", true},
+		{"zk_avg_readlatency", "", "", false},
+		{"zk_packets_received", "", "", false},
+	} {
+		family, stat, ok := splitSummaryKey(tc.key)
+		assert.Equal(t, ok, tc.ok, tc.key)
+		assert.Equal(t, family, tc.family, tc.key)
+		assert.Equal(t, stat, tc.stat, tc.key)
+	}
+}
+
+func TestSummaries(t *testing.T) {
+	stats := map[string]string{
+		"zk_avg_readlatency":          "0.1",
+		"zk_cnt_readlatency":          "19120",
+		"zk_sum_readlatency":          "1912",
+		"zk_p50_readlatency":          "0",
+		"zk_p99_readlatency":          "1",
+		"zk_write_latency_count":      "10",
+		"zk_write_latency_sum":        "25.5",
+		"zk_write_latency_p95":        "4",
+		zkDigestMismatches:            "0",
+		"zk_cnt_not_a_summary":        "4",
+		"zk_cnt_broken_summary":       "lots",
+		"zk_sum_broken_summary":       "12",
+		"zk_something_else_p50":       "1",
+		"zk_something_else_p50_extra": "2",
+	}
+
+	t.Run("families with a count and a sum become summaries", func(t *testing.T) {
+		m := newMetrics()
+		m.refresh("10.0.0.1:2181", stats, nil)
+
+		want := `
+# HELP zk_avg_readlatency Value of zk_avg_readlatency as reported by the mntr command
+# TYPE zk_avg_readlatency gauge
+zk_avg_readlatency{zk_instance="10.0.0.1:2181"} 0.1
+# HELP zk_cnt_not_a_summary Value of zk_cnt_not_a_summary as reported by the mntr command
+# TYPE zk_cnt_not_a_summary gauge
+zk_cnt_not_a_summary{zk_instance="10.0.0.1:2181"} 4
+# HELP zk_readlatency Latency of read requests, in milliseconds
+# TYPE zk_readlatency summary
+zk_readlatency{zk_instance="10.0.0.1:2181",quantile="0.5"} 0
+zk_readlatency{zk_instance="10.0.0.1:2181",quantile="0.99"} 1
+zk_readlatency_sum{zk_instance="10.0.0.1:2181"} 1912
+zk_readlatency_count{zk_instance="10.0.0.1:2181"} 19120
+# HELP zk_write_latency Summary of zk_write_latency as reported by the mntr command
+# TYPE zk_write_latency summary
+zk_write_latency{zk_instance="10.0.0.1:2181",quantile="0.95"} 4
+zk_write_latency_sum{zk_instance="10.0.0.1:2181"} 25.5
+zk_write_latency_count{zk_instance="10.0.0.1:2181"} 10
+`
+		err := testutil.CollectAndCompare(m, strings.NewReader(want),
+			"zk_avg_readlatency", "zk_cnt_not_a_summary", "zk_readlatency", "zk_write_latency",
+			"zk_cnt_readlatency", "zk_sum_readlatency", "zk_p50_readlatency", "zk_write_latency_p95", "zk_broken_summary")
+		assert.NilError(t, err)
+
+		// a broken summary falls back to gauges, for whatever is numeric
+		assert.Equal(t, testutil.CollectAndCount(m, "zk_sum_broken_summary"), 1)
+		assert.Equal(t, testutil.CollectAndCount(m, "zk_cnt_broken_summary"), 0)
+		assert.Equal(t, testutil.CollectAndCount(m, "zk_digest_mismatches_total"), 1)
+	})
+
+	t.Run("legacy gauges", func(t *testing.T) {
+		*legacyGauges = true
+		defer func() { *legacyGauges = false }()
+		m := newMetrics()
+		m.refresh("10.0.0.1:2181", stats, nil)
+
+		assert.Equal(t, testutil.CollectAndCount(m, "zk_readlatency"), 1)
+		for _, key := range []string{"zk_cnt_readlatency", "zk_sum_readlatency", "zk_p99_readlatency", "zk_write_latency_p95"} {
+			assert.Equal(t, testutil.CollectAndCount(m, key), 1, key)
+		}
+		// already the names of the summary's series
+		assert.Equal(t, testutil.CollectAndCount(m, "zk_write_latency"), 1)
+	})
+}
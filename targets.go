@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	configLastReloadSuccessful = "config_last_reload_successful"
+	configLastReloadSuccess    = "config_last_reload_success_timestamp_seconds"
+)
+
+// runner is a goroutine that runs until stopped
+type runner struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func startRunner(run func(ctx context.Context)) *runner {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &runner{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		run(ctx)
+	}()
+	return r
+}
+
+// stop cancels the runner, and waits for it to return
+func (r *runner) stop() {
+	r.cancel()
+	r.wait()
+}
+
+// wait waits for the runner to return, e.g. after cancelling it
+func (r *runner) wait() {
+	<-r.done
+}
+
+// discoverer finds the servers to poll, calling update with all of them on startup and whenever they change, until
+// ctx is cancelled
+type discoverer interface {
+	run(ctx context.Context, update func([]*zkServer))
+	String() string
+}
+
+// canaryRunner is the canary of one ensemble, along with the members it was started for
+type canaryRunner struct {
+	*runner
+	servers []*zkServer
+}
+
+// targetManager keeps track of the servers we poll, so they can be changed on reload without restarting. In poll mode
+// it runs a poller per server and a canary per ensemble; in scrape mode (metrics is nil) the scrape handler just asks
+// it for the current servers.
+type targetManager struct {
+	// serialises apply and resolveAgain, which wait for removed pollers with mu released
+	switchMu sync.Mutex
+	// guards servers and targets; only ever held briefly, so /metrics doesn't wait for a reload
+	mu      sync.Mutex
+	servers []*zkServer
+
+	// poll mode; pollers, canaries and dnsRefresh are guarded by switchMu
+	metrics  *zkMetrics
+	pollers  map[string]*runner
+	canaries map[string]*canaryRunner
+
+	// polling failures; in scrape mode this is what keeps them across scrapes
+	failures *prometheus.CounterVec
+
+	reloadSuccessful prometheus.Gauge
+	reloadTimestamp  prometheus.Gauge
+
+	// generation of the last apply started (guarded by mu) and switched to (guarded by switchMu), so an apply whose
+	// lookups outlast a later one's doesn't switch back to older servers
+	started, switched uint64
+
+	// the servers as applied, before resolving DNS targets, and what re-resolves them
+	targets    []*zkServer
+	dnsRefresh *runner
+
+	// set if the servers are discovered rather than loaded
+	discoverer discoverer
+	discovery  *runner
+}
+
+func newTargetManager(metrics *zkMetrics) *targetManager {
+	failures := newFailureCounter()
+	if metrics != nil {
+		failures = metrics.pollingFailureCounter
+	}
+	return &targetManager{
+		metrics:  metrics,
+		pollers:  make(map[string]*runner),
+		canaries: make(map[string]*canaryRunner),
+		failures: failures,
+		reloadSuccessful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: prependNamespace(configLastReloadSuccessful),
+			Help: "Whether the last configuration reload succeeded",
+		}),
+		reloadTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: prependNamespace(configLastReloadSuccess),
+			Help: "Unix timestamp of the last successful configuration reload",
+		}),
+	}
+}
+
+// Describe implements prometheus.Collector, for the reload metrics
+func (tm *targetManager) Describe(ch chan<- *prometheus.Desc) {
+	tm.reloadSuccessful.Describe(ch)
+	tm.reloadTimestamp.Describe(ch)
+}
+
+// Collect implements prometheus.Collector, for the reload metrics
+func (tm *targetManager) Collect(ch chan<- prometheus.Metric) {
+	tm.reloadSuccessful.Collect(ch)
+	tm.reloadTimestamp.Collect(ch)
+}
+
+// current returns the servers we currently poll
+func (tm *targetManager) current() []*zkServer {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.servers
+}
+
+// reload loads the targets again, and applies them
+func (tm *targetManager) reload() error {
+	if tm.discoverer != nil {
+		return fmt.Errorf("the targets are discovered from %v, there is nothing to reload", tm.discoverer)
+	}
+	servers, err := loadTargets(false)
+	if err != nil {
+		tm.reloadSuccessful.Set(0)
+		return err
+	}
+	tm.apply(servers)
+	return nil
+}
+
+// apply switches over to servers, resolving the DNS targets among them first. They are resolved again every
+// --zk.dns-refresh-interval from then on, if it isn't 0.
+func (tm *targetManager) apply(servers []*zkServer) {
+	tm.mu.Lock()
+	tm.started++
+	generation := tm.started
+	tm.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsResolveTimeout)
+	defer cancel()
+	resolved := resolveTargets(ctx, servers, tm.current())
+
+	tm.switchMu.Lock()
+	defer tm.switchMu.Unlock()
+	if generation < tm.switched {
+		log.Infof("dropping outdated targets, newer ones were applied while resolving them")
+		return
+	}
+	tm.switched = generation
+	tm.mu.Lock()
+	tm.targets = servers
+	tm.mu.Unlock()
+	tm.switchTo(resolved)
+	if tm.dnsRefresh == nil && *dnsRefreshInterval > 0 && hasDNSTargets(servers) {
+		tm.dnsRefresh = startRunner(tm.refreshDNS)
+	}
+	tm.reloadSuccessful.Set(1)
+	tm.reloadTimestamp.Set(float64(time.Now().UnixNano()) / 1e9)
+}
+
+// refreshDNS resolves the DNS targets again every --zk.dns-refresh-interval, until ctx is cancelled
+func (tm *targetManager) refreshDNS(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(*dnsRefreshInterval) * time.Second):
+		}
+
+		tm.resolveAgain(ctx)
+	}
+}
+
+// resolveAgain resolves the DNS targets again, and switches over to the servers they now resolve to
+func (tm *targetManager) resolveAgain(ctx context.Context) {
+	tm.mu.Lock()
+	targets, current := tm.targets, tm.servers
+	tm.mu.Unlock()
+
+	resolveCtx, cancel := context.WithTimeout(ctx, dnsResolveTimeout)
+	defer cancel()
+	resolved := resolveTargets(resolveCtx, targets, current)
+	if ctx.Err() != nil {
+		// stopped, and the lookups failed because of it
+		return
+	}
+
+	tm.switchMu.Lock()
+	defer tm.switchMu.Unlock()
+	// unless they were reloaded in the meantime
+	if sameServers(tm.targets, targets) {
+		tm.switchTo(resolved)
+	}
+}
+
+// switchTo switches over to servers. Servers whose address and settings haven't changed keep running (and keep their
+// zkServer, with its caches); removed or changed ones are stopped and their series deleted before new ones start.
+// They are all cancelled before waiting for any of them, so hung polls time out together. tm.switchMu must be held, and
+// tm.mu not, as it's only taken to publish the new servers.
+func (tm *targetManager) switchTo(servers []*zkServer) {
+	old := make(map[string]*zkServer)
+	for _, zk := range tm.servers {
+		old[zk.ipPort] = zk
+	}
+
+	var added []*zkServer
+	keep := make(map[string]bool)
+	for i, zk := range servers {
+		if prev, ok := old[zk.ipPort]; ok && reflect.DeepEqual(prev.targetSettings, zk.targetSettings) {
+			servers[i] = prev
+			keep[zk.ipPort] = true
+			continue
+		}
+		added = append(added, zk)
+	}
+
+	var removed []*zkServer
+	for _, zk := range tm.servers {
+		if !keep[zk.ipPort] {
+			removed = append(removed, zk)
+		}
+	}
+
+	var stopping []*runner
+	var stoppedCanaries []string
+	ensembles := canaryEnsembles(servers)
+	for ensemble, c := range tm.canaries {
+		if !sameServers(c.servers, ensembles[ensemble]) {
+			c.cancel()
+			stopping = append(stopping, c.runner)
+			stoppedCanaries = append(stoppedCanaries, ensemble)
+			delete(tm.canaries, ensemble)
+		}
+	}
+	for _, zk := range removed {
+		if p, ok := tm.pollers[zk.ipPort]; ok {
+			p.cancel()
+			stopping = append(stopping, p)
+			delete(tm.pollers, zk.ipPort)
+		}
+		zk.tree.stop()
+	}
+	for _, r := range stopping {
+		r.wait()
+	}
+
+	// only now that they are stopped, so they can't export anything after we forget it
+	if tm.metrics != nil {
+		for _, ensemble := range stoppedCanaries {
+			tm.metrics.forgetCanary(ensemble)
+		}
+	}
+	for _, zk := range removed {
+		if tm.metrics != nil {
+			tm.metrics.forget(zk.ipPort)
+		} else {
+			tm.failures.DeleteLabelValues(zk.metricLabels()...)
+		}
+		log.Infof("[%v] stopped polling", zk.ipPort)
+	}
+	closeIdleConnections(removed, servers)
+
+	for _, zk := range added {
+		if tm.metrics != nil {
+			p := newPoller(zk.pollInterval, tm.metrics, zk)
+			tm.pollers[zk.ipPort] = startRunner(p.pollForMetrics)
+		} else {
+			tm.failures.WithLabelValues(zk.metricLabels()...).Add(0)
+		}
+		log.Infof("[%v] started polling, ensemble %q, every %v", zk.ipPort, zk.ensemble, zk.pollInterval)
+	}
+
+	if tm.metrics != nil {
+		for ensemble, members := range ensembles {
+			if _, ok := tm.canaries[ensemble]; ok {
+				continue
+			}
+			c := newCanary(members[0].pollInterval, tm.metrics, ensemble, members)
+			tm.canaries[ensemble] = &canaryRunner{runner: startRunner(c.run), servers: members}
+		}
+	}
+
+	tm.mu.Lock()
+	tm.servers = servers
+	tm.mu.Unlock()
+}
+
+// discover applies the servers d finds until stopAll, instead of loading them. Called once, on startup
+func (tm *targetManager) discover(d discoverer) {
+	tm.discoverer = d
+	tm.discovery = startRunner(func(ctx context.Context) {
+		d.run(ctx, tm.apply)
+	})
+}
+
+// stopAll stops discovery, DNS refreshes and every poller, canary and tree crawl, on shutdown
+func (tm *targetManager) stopAll() {
+	// discovery first, so it doesn't start anything new
+	if tm.discovery != nil {
+		tm.discovery.stop()
+	}
+	if tm.dnsRefresh != nil {
+		tm.dnsRefresh.stop()
+	}
+
+	tm.switchMu.Lock()
+	defer tm.switchMu.Unlock()
+
+	var stopping []*runner
+	for ensemble, c := range tm.canaries {
+		c.cancel()
+		stopping = append(stopping, c.runner)
+		delete(tm.canaries, ensemble)
+	}
+	for ipPort, p := range tm.pollers {
+		p.cancel()
+		stopping = append(stopping, p)
+		delete(tm.pollers, ipPort)
+	}
+	for _, zk := range tm.current() {
+		zk.tree.stop()
+	}
+	for _, r := range stopping {
+		r.wait()
+	}
+	closeIdleConnections(tm.current(), nil)
+}
+
+func sameServers(a, b []*zkServer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// reloadHandler serves POST /-/reload
+func (tm *targetManager) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := tm.reload(); err != nil {
+		log.Errorf("failed to reload: %v", err)
+		http.Error(w, "failed to reload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("reloaded")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	"gotest.tools/poll"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTargetManagerApply(t *testing.T) {
+	defer func(timeout int, deadline float64, interval int) {
+		*zkTimeout, *zkRWDeadLine, *pollInterval = timeout, deadline, interval
+	}(*zkTimeout, *zkRWDeadLine, *pollInterval)
+	*zkTimeout, *zkRWDeadLine, *pollInterval = 1, 1, 30
+
+	metrics := newMetrics()
+	tm := newTargetManager(metrics)
+	// nothing listens on port 1
+	a, b := newZKServer("127.0.0.1:1"), newZKServer("127.0.0.2:1")
+	tm.apply([]*zkServer{a, b})
+
+	instances := func() []string {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		var names []string
+		for name := range metrics.instances {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	// pollers add their instance once started
+	waitForInstances := func(want ...string) {
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			if got := instances(); !reflect.DeepEqual(got, want) {
+				return poll.Continue("instances are %v", got)
+			}
+			return poll.Success()
+		})
+	}
+	waitForInstances("127.0.0.1:1", "127.0.0.2:1")
+
+	// b is unchanged, c is new, a is gone
+	unchangedB, c := newZKServer("127.0.0.2:1"), newZKServer("127.0.0.3:1")
+	tm.apply([]*zkServer{unchangedB, c})
+	assert.Assert(t, tm.current()[0] == b, "unchanged server should be kept")
+	assert.Assert(t, tm.current()[1] == c)
+	assert.Equal(t, len(tm.pollers), 2)
+	waitForInstances("127.0.0.2:1", "127.0.0.3:1")
+
+	// a change of settings restarts the server
+	changedC := newZKServer("127.0.0.3:1")
+	changedC.ensemble = "other"
+	tm.apply([]*zkServer{b, changedC})
+	assert.Assert(t, tm.current()[1] == changedC)
+	assert.Equal(t, testutil.ToFloat64(tm.reloadSuccessful), float64(1))
+
+	tm.apply(nil)
+	assert.Equal(t, len(tm.pollers), 0)
+	assert.Equal(t, len(instances()), 0)
+}
+
+func TestTargetManagerRemovesHungTargets(t *testing.T) {
+	var fakes []*fakeZK
+	var servers []*zkServer
+	for i := 0; i < 3; i++ {
+		f, zk := startFakeZK(t)
+		defer f.close()
+		f.setDelay(time.Second)
+		zk.rwDeadline, zk.pollInterval = 3*time.Second, 30*time.Second
+		fakes, servers = append(fakes, f), append(servers, zk)
+	}
+
+	tm := newTargetManager(newMetrics())
+	tm.apply(servers)
+	// every poller is in the middle of its first poll
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		for _, f := range fakes {
+			if f.requestCount(monitorCMD) == 0 {
+				return poll.Continue("%v not polled yet", f.addr())
+			}
+		}
+		return poll.Success()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tm.apply(nil)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// the reload waits for the hung polls, but doesn't keep anybody from looking at the servers meanwhile
+	start := time.Now()
+	assert.Equal(t, len(tm.current()), 3)
+	assert.Assert(t, time.Since(start) < 100*time.Millisecond)
+	<-done
+	assert.Equal(t, len(tm.current()), 0)
+}
+
+func TestTargetManagerReload(t *testing.T) {
+	defer func() { *configFile, targetLabelNames = "", nil }()
+
+	write := func(content string) {
+		assert.NilError(t, ioutil.WriteFile(*configFile, []byte(content), 0644))
+	}
+	f, err := ioutil.TempFile("", "zookeeper_exporter*.yml")
+	assert.NilError(t, err)
+	assert.NilError(t, f.Close())
+	defer os.Remove(f.Name())
+	*configFile = f.Name()
+
+	write(`
+ensembles:
+  - {name: a, members: [127.0.0.1:1], labels: {env: prod}}
+`)
+	servers, err := loadTargets(true)
+	assert.NilError(t, err)
+	tm := newTargetManager(nil)
+	tm.apply(servers)
+	defer tm.stopAll()
+
+	write(`
+ensembles:
+  - {name: a, members: [127.0.0.1:1, 127.0.0.2:1], labels: {env: prod}}
+  - {name: b, members: [127.0.0.3:1]}
+`)
+	assert.NilError(t, tm.reload())
+	assert.Equal(t, len(tm.current()), 3)
+	assert.DeepEqual(t, tm.current()[2].labels, []string{""})
+
+	t.Run("new label names need a restart", func(t *testing.T) {
+		write(`
+ensembles:
+  - {name: a, members: [127.0.0.1:1], labels: {env: prod, dc: ams}}
+`)
+		assert.ErrorContains(t, tm.reload(), `new label "dc" needs a restart`)
+		assert.Equal(t, testutil.ToFloat64(tm.reloadSuccessful), float64(0))
+		assert.Equal(t, len(tm.current()), 3)
+	})
+}
+
+func TestReloadHandler(t *testing.T) {
+	tm := newTargetManager(nil)
+	rec := httptest.NewRecorder()
+	tm.reloadHandler(rec, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	assert.Equal(t, rec.Code, http.StatusMethodNotAllowed)
+	assert.Equal(t, rec.Header().Get("Allow"), http.MethodPost)
+}
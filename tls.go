@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const tlsCertNotAfter = "tls_certificate_not_after_timestamp_seconds"
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	// built from the --zk.tls.* flags by setupTLS(), nil if TLS is disabled
+	zkTLSConfig *tls.Config
+	// the client for zkTLSConfig, shared by every server using it so they share a connection pool
+	zkHTTPClient = http.DefaultClient
+)
+
+// newTLSConfig builds the client side TLS config used to talk to ZK's secureClientPort. caFile, certFile and keyFile
+// are all optional: without a CA the system roots are used, without a cert / key no client certificate is presented
+func newTLSConfig(caFile, certFile, keyFile, serverName, minVersion string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q", minVersion)
+	}
+
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: version,
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %v", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("client certificate and key must be given together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// builds zkTLSConfig from the --zk.tls.* flags, called once on startup
+func setupTLS() error {
+	if !*zkTLSEnabled {
+		return nil
+	}
+
+	cfg, err := newTLSConfig(*zkTLSCAFile, *zkTLSCertFile, *zkTLSKeyFile, *zkTLSServerName, *zkTLSMinVersion)
+	if err != nil {
+		return fmt.Errorf("invalid --zk.tls.* flags: %v", err)
+	}
+	zkTLSConfig, zkHTTPClient = cfg, newHTTPClient(cfg)
+	return nil
+}
+
+// newHTTPClient returns the client used to talk to AdminServers, using tlsConfig for https:// ones
+func newHTTPClient(tlsConfig *tls.Config) *http.Client {
+	if tlsConfig == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+}
+
+// closeIdleConnections closes the idle AdminServer connections of the servers' clients, unless a server in keep still
+// uses the client. For servers that are no longer polled, whose connections would otherwise linger
+func closeIdleConnections(servers, keep []*zkServer) {
+	inUse := map[*http.Client]bool{http.DefaultClient: true}
+	for _, zk := range keep {
+		inUse[zk.httpClient] = true
+	}
+	for _, zk := range servers {
+		if !inUse[zk.httpClient] {
+			zk.httpClient.CloseIdleConnections()
+			inUse[zk.httpClient] = true
+		}
+	}
+}
+
+// records when the server's certificate expires, from a TLS connection we just made
+func (zk *zkServer) recordPeerCertificate(state tls.ConnectionState) {
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+
+	zk.tlsMu.Lock()
+	defer zk.tlsMu.Unlock()
+	zk.certNotAfter = state.PeerCertificates[0].NotAfter
+}
+
+// pollTLS exports when the server's certificate expires, as seen by the last TLS connection to it
+func pollTLS(zk *zkServer, metrics *zkMetrics) {
+	zk.tlsMu.Lock()
+	notAfter := zk.certNotAfter
+	zk.tlsMu.Unlock()
+
+	if notAfter.IsZero() {
+		return
+	}
+	metrics.refreshExtra(zk.ipPort, tlsCertNotAfter, func() []zkSample {
+		return []zkSample{{
+			desc:  metrics.descWithHelp(tlsCertNotAfter, "Unix timestamp when the zk instance's TLS certificate expires"),
+			value: float64(notAfter.UnixNano()) / float64(time.Second),
+		}}
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// generates a self signed certificate for 127.0.0.1, returning it along with its PEM encoding
+func newTestCertificate(t *testing.T, notAfter time.Time) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "zookeeper"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NilError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Run("unknown version", func(t *testing.T) {
+		_, err := newTLSConfig("", "", "", "", "0.9")
+		assert.Assert(t, err != nil)
+	})
+
+	t.Run("cert without key", func(t *testing.T) {
+		_, err := newTLSConfig("", "client.crt", "", "", "1.2")
+		assert.Assert(t, err != nil)
+	})
+}
+
+func TestSendCommandOverTLS(t *testing.T) {
+	defer func(timeout int, deadline float64) { *zkTimeout, *zkRWDeadLine = timeout, deadline }(*zkTimeout, *zkRWDeadLine)
+	*zkTimeout, *zkRWDeadLine = 1, 1
+
+	notAfter := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	cert, caPEM := newTestCertificate(t, notAfter)
+
+	dir, err := ioutil.TempDir("", "zk-tls")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NilError(t, ioutil.WriteFile(caFile, caPEM, 0600))
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.NilError(t, err)
+	defer l.Close()
+
+	// answers a single ruok, like ZK's secureClientPort would
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("imok"))
+	}()
+
+	cfg, err := newTLSConfig(caFile, "", "", "", "1.2")
+	assert.NilError(t, err)
+
+	zk := newZKServer(l.Addr().String())
+	zk.tlsConfig = cfg
+
+	isOK, err := zk.getOKStatus(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, isOK, "imok")
+	assert.Assert(t, zk.certNotAfter.Equal(notAfter))
+}
+
+// idleCounter is a RoundTripper counting how often its idle connections were closed
+type idleCounter struct {
+	http.RoundTripper
+	closed int
+}
+
+func (c *idleCounter) CloseIdleConnections() {
+	c.closed++
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	shared, own := &idleCounter{}, &idleCounter{}
+	sharedClient := &http.Client{Transport: shared}
+	a, b, c := newZKServer("https://zk1:8080"), newZKServer("https://zk2:8080"), newZKServer("https://zk3:8080")
+	a.httpClient, b.httpClient, c.httpClient = sharedClient, sharedClient, &http.Client{Transport: own}
+
+	// b still uses the shared client
+	closeIdleConnections([]*zkServer{a, c}, []*zkServer{b})
+	assert.Equal(t, shared.closed, 0)
+	assert.Equal(t, own.closed, 1)
+
+	closeIdleConnections([]*zkServer{a, b}, nil)
+	assert.Equal(t, shared.closed, 1)
+}
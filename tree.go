@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	treeZnodes          = "znode_tree_znodes"
+	treeDataBytes       = "znode_tree_data_bytes"
+	treeEphemeralZnodes = "znode_tree_ephemeral_znodes"
+	treeMaxChildren     = "znode_tree_max_children"
+	treeTruncated       = "znode_tree_truncated"
+	treeLastCrawl       = "znode_tree_last_crawl_timestamp_seconds"
+
+	treeSessionTimeout = 30 * time.Second
+)
+
+// parsed --tree.roots, see setupTree()
+var treeRoots []string
+
+// subtreeStats sums up the znodes below (and including) one root
+type subtreeStats struct {
+	znodes      int64
+	dataBytes   int64
+	ephemerals  int64
+	maxChildren int32
+	// the crawl hit --tree.max-depth or --tree.max-znodes, so the numbers are a lower bound
+	truncated bool
+}
+
+// treeStats is the result of crawling all roots of one server
+type treeStats struct {
+	roots   map[string]*subtreeStats
+	crawled time.Time
+}
+
+// treeCrawler keeps the result of the last crawl of a server, and makes sure only one crawl runs at a time
+type treeCrawler struct {
+	mu        sync.Mutex
+	stats     *treeStats
+	running   bool
+	lastStart time.Time
+	// cancels the running crawl
+	cancel context.CancelFunc
+	// set once the server is no longer polled, so no new crawl starts
+	stopped bool
+}
+
+// stop cancels the running crawl, if any, and keeps new ones from starting. Called when the server is no longer polled
+func (t *treeCrawler) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+// crawlTree walks every root with getChildren2, which returns the children and the stat of a znode in one request,
+// depth first and within the --tree.max-depth, --tree.max-znodes and --tree.rate limits
+func (zk *zkServer) crawlTree(ctx context.Context, roots []string) (*treeStats, error) {
+	c, err := zk.openSession(ctx, treeSessionTimeout, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := c.close(ctx); err != nil {
+			log.Debugf("[%v] failed to close tree crawl session: %v", zk.ipPort, err)
+		}
+	}()
+
+	var limiter <-chan time.Time
+	if *treeRate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(*treeRate))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	type znode struct {
+		path  string
+		depth int
+	}
+
+	stats := &treeStats{roots: make(map[string]*subtreeStats)}
+	requests := 0
+	for _, root := range roots {
+		s := &subtreeStats{}
+		stats.roots[root] = s
+
+		stack := []znode{{path: root}}
+		for len(stack) > 0 {
+			if *treeMaxZnodes > 0 && requests >= *treeMaxZnodes {
+				s.truncated = true
+				break
+			}
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			if limiter != nil {
+				select {
+				case <-ctx.Done():
+				case <-limiter:
+				}
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			requests++
+			children, stat, err := c.getChildren(ctx, n.path)
+			if err == zkErrNoNode {
+				// deleted while we were crawling
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to get children of %v: %v", n.path, err)
+			}
+
+			s.znodes++
+			s.dataBytes += int64(stat.dataLength)
+			if stat.ephemeralOwner != 0 {
+				s.ephemerals++
+			}
+			if stat.numChildren > s.maxChildren {
+				s.maxChildren = stat.numChildren
+			}
+
+			if len(children) == 0 {
+				continue
+			}
+			if *treeMaxDepth > 0 && n.depth >= *treeMaxDepth {
+				s.truncated = true
+				continue
+			}
+			for _, child := range children {
+				stack = append(stack, znode{path: path.Join(n.path, child), depth: n.depth + 1})
+			}
+		}
+	}
+
+	stats.crawled = time.Now()
+	return stats, nil
+}
+
+// pollTree exports the result of the last crawl of a server, and starts a new crawl in the background if the last one
+// is older than interval. Crawls can take much longer than a poll, so they never hold up the poller; they run until
+// done, or until the server is no longer polled (see treeCrawler.stop).
+func pollTree(zk *zkServer, metrics *zkMetrics, interval time.Duration) {
+	t := &zk.tree
+	t.mu.Lock()
+	stats := t.stats
+	if !t.running && !t.stopped && time.Since(t.lastStart) >= interval {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.running = true
+		t.lastStart = time.Now()
+		t.cancel = cancel
+		go func() {
+			defer cancel()
+			stats, err := zk.crawlTree(ctx, treeRoots)
+			if err != nil && ctx.Err() == nil {
+				log.Warnf("[%v] failed to crawl znode tree: %v", zk.ipPort, err)
+			}
+
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.running = false
+			t.cancel = nil
+			if err == nil {
+				t.stats = stats
+			}
+		}()
+	}
+	t.mu.Unlock()
+
+	if stats != nil {
+		metrics.refreshTree(zk.ipPort, stats)
+	}
+}
+
+var treeLabels = exporterLabels("root")
+
+// refreshTree converts the result of a crawl into per root metrics
+func (m *zkMetrics) refreshTree(instance string, stats *treeStats) {
+	m.refreshExtra(instance, "tree", func() []zkSample {
+		samples := []zkSample{{
+			desc:  m.descWithHelp(treeLastCrawl, "Unix timestamp of the last completed crawl of the znode tree"),
+			value: float64(stats.crawled.UnixNano()) / 1e9,
+		}}
+
+		for root, s := range stats.roots {
+			truncated := 0.0
+			if s.truncated {
+				truncated = 1
+			}
+			for _, v := range []struct {
+				name  string
+				help  string
+				value float64
+			}{
+				{treeZnodes, "Number of znodes in the subtree", float64(s.znodes)},
+				{treeDataBytes, "Total data size of the znodes in the subtree in bytes", float64(s.dataBytes)},
+				{treeEphemeralZnodes, "Number of ephemeral znodes in the subtree", float64(s.ephemerals)},
+				{treeMaxChildren, "Largest number of children of any znode in the subtree", float64(s.maxChildren)},
+				{treeTruncated, "1 if the crawl of the subtree hit the depth or znode limit, so the other numbers are a lower bound", truncated},
+			} {
+				samples = append(samples, zkSample{
+					desc:   m.descWithHelp(v.name, v.help, treeLabels...),
+					value:  v.value,
+					labels: []string{root},
+				})
+			}
+		}
+		return samples
+	})
+}
+
+// setupTree parses --tree.roots
+func setupTree() error {
+	treeRoots = nil
+	for _, root := range strings.Split(*treeRootsList, ",") {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		}
+		if !strings.HasPrefix(root, "/") {
+			return fmt.Errorf("invalid --tree.roots: %q is not an absolute path", root)
+		}
+		treeRoots = append(treeRoots, path.Clean(root))
+	}
+	if *treeEnabled && len(treeRoots) == 0 {
+		return fmt.Errorf("--collector.tree needs at least one --tree.roots path")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"gotest.tools/assert"
+	"gotest.tools/poll"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCrawlTree(t *testing.T) {
+	defer func(timeout int, deadline float64) { *zkTimeout, *zkRWDeadLine = timeout, deadline }(*zkTimeout, *zkRWDeadLine)
+	defer func(depth, znodes, rate int) {
+		*treeMaxDepth, *treeMaxZnodes, *treeRate = depth, znodes, rate
+	}(*treeMaxDepth, *treeMaxZnodes, *treeRate)
+	*zkTimeout, *zkRWDeadLine = 1, 1
+	*treeRate = 0
+
+	tree := map[string][]byte{
+		"/":                         nil,
+		"/app1":                     []byte("12345"),
+		"/app1/locks":               nil,
+		"/app1/locks/lock-01":       []byte("a"),
+		"/app1/locks/lock-02":       []byte("b"),
+		"/app1/locks/lock-03":       []byte("c"),
+		"/app1/config":              []byte("1234567890"),
+		"/app1/config/deep":         nil,
+		"/app1/config/deep/deeper":  nil,
+		"/app2":                     nil,
+		"/app2/members":             nil,
+		"/app2/members/member-0001": []byte("host1"),
+	}
+	s := newFakeClientServer(t, &sync.Mutex{}, tree)
+	defer s.close()
+	s.ephemeral["/app1/locks/lock-01"] = true
+	s.ephemeral["/app1/locks/lock-02"] = true
+	s.ephemeral["/app2/members/member-0001"] = true
+	zk := newZKServer(s.addr())
+
+	for _, tc := range []struct {
+		name      string
+		maxDepth  int
+		maxZnodes int
+		roots     []string
+		expected  map[string]subtreeStats
+	}{
+		{
+			name:     "whole subtrees",
+			maxDepth: 0,
+			roots:    []string{"/app1", "/app2", "/missing"},
+			expected: map[string]subtreeStats{
+				"/app1":    {znodes: 8, dataBytes: 18, ephemerals: 2, maxChildren: 3},
+				"/app2":    {znodes: 3, dataBytes: 5, ephemerals: 1, maxChildren: 1},
+				"/missing": {},
+			},
+		},
+		{
+			name:     "depth limit",
+			maxDepth: 1,
+			roots:    []string{"/app1"},
+			expected: map[string]subtreeStats{
+				"/app1": {znodes: 3, dataBytes: 15, maxChildren: 3, truncated: true},
+			},
+		},
+		{
+			name:      "znode budget shared by all roots",
+			maxZnodes: 9,
+			roots:     []string{"/app1", "/app2"},
+			expected: map[string]subtreeStats{
+				"/app1": {znodes: 8, dataBytes: 18, ephemerals: 2, maxChildren: 3},
+				"/app2": {znodes: 1, maxChildren: 1, truncated: true},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			*treeMaxDepth, *treeMaxZnodes = tc.maxDepth, tc.maxZnodes
+
+			stats, err := zk.crawlTree(context.Background(), tc.roots)
+			assert.NilError(t, err)
+			assert.Equal(t, len(stats.roots), len(tc.expected))
+			for root, expected := range tc.expected {
+				assert.Equal(t, *stats.roots[root], expected, root)
+			}
+		})
+	}
+
+	t.Run("stopping cancels the crawl", func(t *testing.T) {
+		// one request a second, so the crawl is still running when we stop it
+		*treeMaxDepth, *treeMaxZnodes, *treeRate = 0, 0, 1
+		defer func(roots []string) { treeRoots = roots }(treeRoots)
+		treeRoots = []string{"/"}
+
+		zk := newZKServer(s.addr())
+		pollTree(zk, newMetrics(), 0)
+		zk.tree.stop()
+
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			zk.tree.mu.Lock()
+			defer zk.tree.mu.Unlock()
+			if zk.tree.running {
+				return poll.Continue("crawl still running")
+			}
+			return poll.Success()
+		}, poll.WithTimeout(5*time.Second))
+		assert.Assert(t, zk.tree.stats == nil)
+
+		// and no new one starts
+		pollTree(zk, newMetrics(), 0)
+		assert.Assert(t, !zk.tree.running)
+	})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	wchsCMD = "wchs"
+	wchcCMD = "wchc"
+	wchpCMD = "wchp"
+
+	wchsConnections       = "wchs_connections"
+	wchsPaths             = "wchs_paths"
+	wchsWatches           = "wchs_watches"
+	sessionWatches        = "session_watches"
+	pathWatches           = "path_watches"
+	watchDetailsSkipped   = "watch_details_skipped"
+	wchsSummaryLineFormat = "%d connections watching %d paths"
+)
+
+// wchsSummary is the output of wchs, e.g.
+// 3 connections watching 5 paths
+// Total watches:7
+type wchsSummary struct {
+	connections float64
+	paths       float64
+	watches     float64
+}
+
+// a watch count for a session or path prefix, as exported by the top-N metrics
+type watchCount struct {
+	key   string
+	count float64
+}
+
+func parseWchs(byts []byte) (wchsSummary, error) {
+	var summary wchsSummary
+	var connections, paths int
+	var hasSummary, hasTotal bool
+
+	scanner := bufio.NewScanner(bytes.NewReader(byts))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "Total watches:") {
+			total, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(line, "Total watches:")), 64)
+			if err != nil {
+				return summary, err
+			}
+			summary.watches, hasTotal = total, true
+			continue
+		}
+		if _, err := fmt.Sscanf(line, wchsSummaryLineFormat, &connections, &paths); err == nil {
+			summary.connections, summary.paths, hasSummary = float64(connections), float64(paths), true
+		}
+	}
+
+	if !hasSummary || !hasTotal {
+		return summary, fmt.Errorf("unexpected wchs output: %q", string(byts))
+	}
+	return summary, nil
+}
+
+// parseWatchList parses wchc and wchp output, which list watches grouped by an unindented header (session id for wchc,
+// path for wchp) followed by tab indented entries (paths for wchc, session ids for wchp). It returns the number of
+// entries under each header, with the header mapped through keyFn
+func parseWatchList(byts []byte, keyFn func(string) string) map[string]float64 {
+	counts := make(map[string]float64)
+	var current string
+
+	scanner := bufio.NewScanner(bytes.NewReader(byts))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, " ") {
+			current = keyFn(strings.TrimSpace(line))
+			continue
+		}
+		if current != "" {
+			counts[current]++
+		}
+	}
+	return counts
+}
+
+// pathPrefix cuts a znode path down to its first depth components, e.g. /app/locks/lock-1 at depth 2 is /app/locks
+func pathPrefix(path string, depth int) string {
+	if depth <= 0 {
+		return path
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// topWatchCounts returns the n biggest counts, biggest first. n <= 0 returns them all
+func topWatchCounts(counts map[string]float64, n int) []watchCount {
+	top := make([]watchCount, 0, len(counts))
+	for key, count := range counts {
+		top = append(top, watchCount{key: key, count: count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].count != top[j].count {
+			return top[i].count > top[j].count
+		}
+		return top[i].key < top[j].key
+	})
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+func (zk *zkServer) getWchs(ctx context.Context) (wchsSummary, error) {
+	byts, err := zk.sendWhitelistedCommand(ctx, wchsCMD)
+	if err != nil {
+		return wchsSummary{}, err
+	}
+	return parseWchs(byts)
+}
+
+// pollWatches runs whichever of wchs, wchc and wchp are enabled. wchc and wchp make the server walk all of its
+// watches, so they are skipped when there are more than --wch.max-watches of them
+func pollWatches(ctx context.Context, zk *zkServer, metrics *zkMetrics) {
+	summary, err := zk.getWchs(ctx)
+	if err != nil {
+		log.Warnf("[%v] failed to get wchs: %v", zk.ipPort, err)
+		// drop whatever we exported before, so it doesn't look current. That includes wchc / wchp, as without wchs we
+		// can't tell whether they would have been skipped
+		for _, collector := range []string{wchsCMD, watchDetailsSkipped, wchcCMD, wchpCMD} {
+			metrics.refreshExtra(zk.ipPort, collector, func() []zkSample { return nil })
+		}
+		return
+	}
+	if zk.collectors[collectorWchs] {
+		metrics.refreshWchs(zk.ipPort, summary)
+	}
+
+	if !zk.collectors[collectorWchc] && !zk.collectors[collectorWchp] {
+		return
+	}
+
+	skip := *wchMaxWatches > 0 && summary.watches > float64(*wchMaxWatches)
+	metrics.refreshWatchGuard(zk.ipPort, skip)
+	if skip {
+		log.Debugf("[%v] %v watches, skipping wchc / wchp", zk.ipPort, summary.watches)
+		// drop whatever we exported before, so it doesn't look current
+		metrics.refreshWatchCounts(zk.ipPort, wchcCMD, nil)
+		metrics.refreshWatchCounts(zk.ipPort, wchpCMD, nil)
+		return
+	}
+
+	if zk.collectors[collectorWchc] {
+		byts, err := zk.sendWhitelistedCommand(ctx, wchcCMD)
+		if err != nil {
+			log.Warnf("[%v] failed to get wchc: %v", zk.ipPort, err)
+			metrics.refreshWatchCounts(zk.ipPort, wchcCMD, nil)
+		} else {
+			perSession := parseWatchList(byts, func(session string) string { return session })
+			metrics.refreshWatchCounts(zk.ipPort, wchcCMD, topWatchCounts(perSession, *wchTopN))
+		}
+	}
+
+	if zk.collectors[collectorWchp] {
+		byts, err := zk.sendWhitelistedCommand(ctx, wchpCMD)
+		if err != nil {
+			log.Warnf("[%v] failed to get wchp: %v", zk.ipPort, err)
+			metrics.refreshWatchCounts(zk.ipPort, wchpCMD, nil)
+		} else {
+			perPrefix := parseWatchList(byts, func(path string) string { return pathPrefix(path, *wchPathDepth) })
+			metrics.refreshWatchCounts(zk.ipPort, wchpCMD, topWatchCounts(perPrefix, *wchTopN))
+		}
+	}
+}
+
+func (m *zkMetrics) refreshWchs(instance string, summary wchsSummary) {
+	m.refreshExtra(instance, wchsCMD, func() []zkSample {
+		return []zkSample{
+			{desc: m.descWithHelp(wchsConnections, "Number of connections with watches, from the wchs command"), value: summary.connections},
+			{desc: m.descWithHelp(wchsPaths, "Number of watched paths, from the wchs command"), value: summary.paths},
+			{desc: m.descWithHelp(wchsWatches, "Total number of watches, from the wchs command"), value: summary.watches},
+		}
+	})
+}
+
+func (m *zkMetrics) refreshWatchGuard(instance string, skipped bool) {
+	m.refreshExtra(instance, watchDetailsSkipped, func() []zkSample {
+		s := zkSample{desc: m.descWithHelp(watchDetailsSkipped, "1 if wchc / wchp were skipped because the server has too many watches")}
+		if skipped {
+			s.value = 1
+		}
+		return []zkSample{s}
+	})
+}
+
+var (
+	sessionLabels    = exporterLabels("session_id")
+	pathPrefixLabels = exporterLabels("path_prefix")
+)
+
+// refreshWatchCounts exports the top-N sessions (wchc) or path prefixes (wchp) by number of watches
+func (m *zkMetrics) refreshWatchCounts(instance, cmd string, counts []watchCount) {
+	m.refreshExtra(instance, cmd, func() []zkSample {
+		desc := m.descWithHelp(sessionWatches, "Number of watches set by the session, from the wchc command", sessionLabels...)
+		if cmd == wchpCMD {
+			desc = m.descWithHelp(pathWatches, "Number of watches on paths under the prefix, from the wchp command", pathPrefixLabels...)
+		}
+
+		samples := make([]zkSample, 0, len(counts))
+		for _, c := range counts {
+			samples = append(samples, zkSample{desc: desc, value: c.count, labels: []string{c.key}})
+		}
+		return samples
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	"testing"
+)
+
+func TestParseWchs(t *testing.T) {
+	summary, err := parseWchs([]byte("3 connections watching 5 paths\nTotal watches:7\n"))
+	assert.NilError(t, err)
+	assert.Equal(t, summary, wchsSummary{connections: 3, paths: 5, watches: 7})
+
+	_, err = parseWchs([]byte("wchs is not executed because it is not in the whitelist.\n"))
+	assert.Assert(t, err != nil)
+}
+
+func TestParseWatchList(t *testing.T) {
+	t.Run("wchc", func(t *testing.T) {
+		out := "0x100007f8a4e0001\n\t/app/config\n\t/app/locks/lock-1\n0x100007f8a4e0002\n\t/app/config\n\n"
+		perSession := parseWatchList([]byte(out), func(s string) string { return s })
+		assert.DeepEqual(t, perSession, map[string]float64{"0x100007f8a4e0001": 2, "0x100007f8a4e0002": 1})
+	})
+
+	t.Run("wchp by path prefix", func(t *testing.T) {
+		out := "/app/config\n\t0x100007f8a4e0001\n\t0x100007f8a4e0002\n/app/locks/lock-1\n\t0x100007f8a4e0001\n/other\n\t0x1\n"
+		perPrefix := parseWatchList([]byte(out), func(p string) string { return pathPrefix(p, 1) })
+		assert.DeepEqual(t, perPrefix, map[string]float64{"/app": 3, "/other": 1})
+	})
+}
+
+func TestPathPrefix(t *testing.T) {
+	assert.Equal(t, pathPrefix("/app/locks/lock-1", 2), "/app/locks")
+	assert.Equal(t, pathPrefix("/app", 2), "/app")
+	assert.Equal(t, pathPrefix("/", 2), "/")
+	assert.Equal(t, pathPrefix("/app/locks/lock-1", 0), "/app/locks/lock-1")
+}
+
+func TestTopWatchCounts(t *testing.T) {
+	top := topWatchCounts(map[string]float64{"a": 1, "b": 5, "c": 5, "d": 2}, 3)
+	assert.Equal(t, len(top), 3)
+	assert.Equal(t, top[0], watchCount{key: "b", count: 5})
+	assert.Equal(t, top[1], watchCount{key: "c", count: 5})
+	assert.Equal(t, top[2], watchCount{key: "d", count: 2})
+}
+
+func TestPollWatches(t *testing.T) {
+	f, zk := startFakeZK(t)
+	defer f.close()
+	zk.collectors = collectorSet{collectorWchs: true, collectorWchc: true, collectorWchp: true}
+	f.setResponse(wchsCMD, "1 connections watching 2 paths\nTotal watches:2\n")
+	f.setResponse(wchcCMD, "0x100000000000001\n\t/app/a\n\t/app/b\n")
+	f.setResponse(wchpCMD, "/app\n\t0x100000000000001\n")
+	metrics := newMetrics()
+	metrics.refresh(zk.ipPort, map[string]string{zkOK: "imok"}, nil)
+
+	pollWatches(context.Background(), zk, metrics)
+	assert.Equal(t, testutil.CollectAndCount(metrics, wchsWatches), 1)
+	assert.Equal(t, testutil.CollectAndCount(metrics, sessionWatches), 1)
+	assert.Equal(t, testutil.CollectAndCount(metrics, pathWatches), 1)
+
+	t.Run("failed wchc / wchp drop their series", func(t *testing.T) {
+		f.setResponse(wchcCMD, "wchc is not executed because it is not in the whitelist.\n")
+		f.setResponse(wchpCMD, "wchp is not executed because it is not in the whitelist.\n")
+		pollWatches(context.Background(), zk, metrics)
+		assert.Equal(t, testutil.CollectAndCount(metrics, wchsWatches), 1)
+		assert.Equal(t, testutil.CollectAndCount(metrics, sessionWatches), 0)
+		assert.Equal(t, testutil.CollectAndCount(metrics, pathWatches), 0)
+	})
+
+	t.Run("failed wchs drops every watch series", func(t *testing.T) {
+		f.setResponse(wchsCMD, "wchs is not executed because it is not in the whitelist.\n")
+		pollWatches(context.Background(), zk, metrics)
+		for _, name := range []string{wchsConnections, wchsPaths, wchsWatches, watchDetailsSkipped} {
+			assert.Equal(t, testutil.CollectAndCount(metrics, name), 0, name)
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ZooKeeper client protocol op codes and special xids
+const (
+	opCreate       int32 = 1
+	opDelete       int32 = 2
+	opExists       int32 = 3
+	opGetData      int32 = 4
+	opGetChildren2 int32 = 12
+	opCloseSession int32 = -11
+
+	xidWatcherEvent int32 = -1
+	xidPing         int32 = -2
+
+	// largest packet we'll accept, same as ZK's default jute.maxbuffer
+	maxPacketSize = 0xfffff
+)
+
+// create modes
+const (
+	createPersistent          int32 = 0
+	createEphemeralSequential int32 = 3
+)
+
+// the exporter is read only, apart from the canary's znodes. Any write on a session that wasn't explicitly made
+// writable is refused before it reaches the server
+var errWritesDisabled = errors.New("refusing to write to zookeeper, the canary is disabled")
+
+// zkClientConn is a minimal ZooKeeper client session, just enough to probe that clients can connect and read
+type zkClientConn struct {
+	zk        *zkServer
+	conn      net.Conn
+	xid       int32
+	sessionID int64
+	// only set by allowWrites()
+	writable bool
+}
+
+// openSession connects to the client port and establishes a new session. readOnly lets the session be established
+// with a server that is partitioned from the quorum and only serving reads
+func (zk *zkServer) openSession(ctx context.Context, sessionTimeout time.Duration, readOnly bool) (*zkClientConn, error) {
+	conn, err := zk.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := &zkClientConn{zk: zk, conn: conn}
+
+	var req juteWriter
+	req.writeInt32(0) // protocol version
+	req.writeInt64(0) // last zxid seen
+	req.writeInt32(int32(sessionTimeout / time.Millisecond))
+	req.writeInt64(0)                 // session id, 0 for a new session
+	req.writeBuffer(make([]byte, 16)) // password
+	req.writeBool(readOnly)
+
+	if err := c.setDeadline(ctx); err != nil {
+		c.closeConn()
+		return nil, err
+	}
+	if err := c.writePacket(req.Bytes()); err != nil {
+		c.closeConn()
+		return nil, err
+	}
+	resp, err := c.readPacket()
+	if err != nil {
+		c.closeConn()
+		return nil, err
+	}
+
+	r := newJuteReader(resp)
+	r.readInt32() // protocol version
+	negotiatedTimeout := r.readInt32()
+	c.sessionID = r.readInt64()
+	r.readBuffer() // password
+	if r.err != nil {
+		c.closeConn()
+		return nil, fmt.Errorf("failed to decode connect response: %v", r.err)
+	}
+	if negotiatedTimeout <= 0 {
+		c.closeConn()
+		return nil, fmt.Errorf("server refused to establish a session")
+	}
+	return c, nil
+}
+
+// allowWrites lets the session create and delete znodes, which only the canary may do, and only if it's enabled for
+// the server
+func (c *zkClientConn) allowWrites() error {
+	if !c.zk.collectors[collectorCanary] {
+		return errWritesDisabled
+	}
+	c.writable = true
+	return nil
+}
+
+// ensure the session fails fast if ZK is having problems, and never outlives ctx
+func (c *zkClientConn) setDeadline(ctx context.Context) error {
+	deadline := time.Now().Add(c.zk.rwDeadline)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	return c.conn.SetDeadline(deadline)
+}
+
+func (c *zkClientConn) writePacket(payload []byte) error {
+	var frame juteWriter
+	frame.writeBuffer(payload)
+	_, err := c.conn.Write(frame.Bytes())
+	return err
+}
+
+func (c *zkClientConn) readPacket() ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(c.conn, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxPacketSize {
+		return nil, fmt.Errorf("packet of %d bytes exceeds maximum of %d", n, maxPacketSize)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.conn, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// request sends one request and waits for its reply, returning a reader positioned at the reply body
+func (c *zkClientConn) request(ctx context.Context, op int32, body []byte) (*juteReader, error) {
+	if (op == opCreate || op == opDelete) && !c.writable {
+		return nil, errWritesDisabled
+	}
+
+	c.xid++
+	xid := c.xid
+
+	var req juteWriter
+	req.writeInt32(xid)
+	req.writeInt32(op)
+	req.Write(body)
+
+	if err := c.setDeadline(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.writePacket(req.Bytes()); err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+
+		r := newJuteReader(resp)
+		replyXid := r.readInt32()
+		r.readInt64() // zxid
+		code := zkError(r.readInt32())
+		if r.err != nil {
+			return nil, fmt.Errorf("failed to decode reply header: %v", r.err)
+		}
+
+		// we never set watches, but skip events and pings rather than choke on them
+		if replyXid == xidWatcherEvent || replyXid == xidPing {
+			continue
+		}
+		if replyXid != xid {
+			return nil, fmt.Errorf("expected reply to xid %d, got %d", xid, replyXid)
+		}
+		if code != 0 {
+			return nil, code
+		}
+		return r, nil
+	}
+}
+
+// request body of exists, getData and getChildren2: a path and a watch flag
+func pathRequest(path string) []byte {
+	var w juteWriter
+	w.writeString(path)
+	w.writeBool(false)
+	return w.Bytes()
+}
+
+func (c *zkClientConn) exists(ctx context.Context, path string) (zkStat, error) {
+	r, err := c.request(ctx, opExists, pathRequest(path))
+	if err != nil {
+		return zkStat{}, err
+	}
+	stat := r.readStat()
+	return stat, r.err
+}
+
+func (c *zkClientConn) getData(ctx context.Context, path string) ([]byte, zkStat, error) {
+	r, err := c.request(ctx, opGetData, pathRequest(path))
+	if err != nil {
+		return nil, zkStat{}, err
+	}
+	data := r.readBuffer()
+	stat := r.readStat()
+	return data, stat, r.err
+}
+
+func (c *zkClientConn) getChildren(ctx context.Context, path string) ([]string, zkStat, error) {
+	r, err := c.request(ctx, opGetChildren2, pathRequest(path))
+	if err != nil {
+		return nil, zkStat{}, err
+	}
+	n := r.readInt32()
+	if n < 0 {
+		// null vector
+		n = 0
+	}
+	var children []string
+	for i := int32(0); i < n && r.err == nil; i++ {
+		children = append(children, r.readString())
+	}
+	stat := r.readStat()
+	return children, stat, r.err
+}
+
+// create creates a world readable and writable znode, returning its actual path, which differs from path for
+// sequential znodes
+func (c *zkClientConn) create(ctx context.Context, path string, data []byte, mode int32) (string, error) {
+	var w juteWriter
+	w.writeString(path)
+	w.writeBuffer(data)
+	// a single ACL: world:anyone with all permissions
+	w.writeInt32(1)
+	w.writeInt32(0x1f)
+	w.writeString("world")
+	w.writeString("anyone")
+	w.writeInt32(mode)
+
+	r, err := c.request(ctx, opCreate, w.Bytes())
+	if err != nil {
+		return "", err
+	}
+	created := r.readString()
+	return created, r.err
+}
+
+// delete deletes a znode, whatever its version
+func (c *zkClientConn) delete(ctx context.Context, path string) error {
+	var w juteWriter
+	w.writeString(path)
+	w.writeInt32(-1)
+
+	_, err := c.request(ctx, opDelete, w.Bytes())
+	return err
+}
+
+// close ends the session, so the server doesn't have to wait for it to time out
+func (c *zkClientConn) close(ctx context.Context) error {
+	_, err := c.request(ctx, opCloseSession, nil)
+	c.closeConn()
+	return err
+}
+
+func (c *zkClientConn) closeConn() {
+	if err := c.conn.Close(); err != nil {
+		log.Errorf("[%v] failed to close connection: %v", c.zk.ipPort, err)
+	}
+}
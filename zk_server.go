@@ -3,49 +3,157 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	monitorCMD = "mntr"
 	okCMD      = "ruok"
-	enviCMD    = "envi" // Might use this in the future?
+	srvrCMD    = "srvr"
+	enviCMD    = "envi"
 )
 
+// returned when a server refuses a command because it isn't in 4lw.commands.whitelist
+var errNotWhitelisted = errors.New("command not in 4lw.commands.whitelist")
+
 // zkServer object
 type zkServer struct {
+	// ip:port of the client port, or the AdminServer URL - used as zk_instance label either way
 	ipPort string
+	// if set, talk to the AdminServer at this URL instead of sending four letter words
+	adminURL string
+	// the dns+ or dnssrv+ target this server was resolved from, if any
+	dnsTarget string
+	targetSettings
+
+	// cached envi / conf output, see getInfo(). If the server refused to run them, when it did so
+	infoMu      sync.Mutex
+	info        *zkInfo
+	infoRefused time.Time
+
+	// if set, four letter words go to the secureClientPort over TLS; also used for https:// AdminServers
+	tlsConfig  *tls.Config
+	httpClient *http.Client
+	// expiry of the server's certificate, as seen on the last TLS connection
+	tlsMu        sync.Mutex
+	certNotAfter time.Time
+
+	// last crawl of the znode tree, see pollTree()
+	tree treeCrawler
+
+	// if set, four letter words go through it rather than over the network, see replayTransport
+	transport commandTransport
 }
 
-// zkServer constructor
+// targetSettings are the per target settings, from the flags or the config file. A target whose settings change on
+// reload is restarted
+type targetSettings struct {
+	// name of the ensemble this server belongs to, empty if unknown
+	ensemble string
+	// values of the targetLabelNames labels added to all of the server's metrics
+	labels []string
+	// address to connect to, if it isn't ipPort: what a DNS target resolved to, ipPort being the name behind it
+	addr string
+
+	pollInterval   time.Duration
+	connectTimeout time.Duration
+	rwDeadline     time.Duration
+	collectors     collectorSet
+	// the config file's tls section tlsConfig was built from, nil if built from the flags
+	tlsFile *tlsFileConfig
+}
+
+// zkServer constructor. Targets starting with http:// or https:// are AdminServer URLs, dns+ and dnssrv+ ones are
+// resolved by the targetManager (see resolveTargets), anything else is ip:port of the client port. Settings default to
+// the flags, the config file can override them afterwards
 func newZKServer(ipPort string) *zkServer {
-	return &zkServer{ipPort: ipPort}
+	zk := &zkServer{
+		ipPort: ipPort,
+		targetSettings: targetSettings{
+			labels:         make([]string, len(targetLabelNames)),
+			pollInterval:   time.Duration(*pollInterval) * time.Second,
+			connectTimeout: time.Duration(*zkTimeout) * time.Second,
+			rwDeadline:     time.Duration(*zkRWDeadLine) * time.Second,
+			collectors:     flagCollectors(),
+		},
+		tlsConfig:  zkTLSConfig,
+		httpClient: zkHTTPClient,
+	}
+	if isAdminURL(ipPort) {
+		zk.adminURL = strings.TrimRight(ipPort, "/")
+	}
+	return zk
 }
 
-// zkServer.getStats() - runs mntr and ruok commands
-func (zk *zkServer) getStats() (map[string]string, error) {
-	stats, err := zk.getMNTR()
+// checkTarget validates a --zk.hosts entry, or any other target: ip:port, an AdminServer URL or a DNS target
+func checkTarget(target string) error {
+	if isDNSTarget(target) {
+		return checkDNSTarget(target)
+	}
+	if !isAdminURL(target) && !strings.Contains(target, ":") {
+		return fmt.Errorf("%q is not ip:port, an http(s):// AdminServer URL or a dns+ / dnssrv+ name", target)
+	}
+	return nil
+}
+
+// zkServer.getStats() - runs mntr and ruok commands, falling back to srvr / stat if mntr isn't whitelisted. ctx bounds
+// the whole exchange, on top of the usual socket timeouts
+func (zk *zkServer) getStats(ctx context.Context) (map[string]string, error) {
+	if zk.adminURL != "" {
+		return zk.getAdminStats(ctx)
+	}
+
+	stats, err := zk.getMNTR(ctx)
+	if err == errNotWhitelisted {
+		log.Debugf("[%v] mntr not whitelisted, falling back to srvr", zk.ipPort)
+		stats, err = zk.getSrvr(ctx)
+	}
 	if err != nil {
 		return stats, err
 	}
 
-	isOK, err := zk.getOKStatus()
-	if err != nil {
+	// a server that doesn't whitelist ruok (3.5's default whitelist is just srvr) isn't necessarily unwell, so leave
+	// zk_ok out rather than reporting it as not ok
+	isOK, err := zk.getOKStatus(ctx)
+	switch {
+	case err == errNotWhitelisted:
+		log.Debugf("[%v] ruok not whitelisted, not exporting zk_ok", zk.ipPort)
+	case err != nil:
 		return stats, err
+	default:
+		stats[zkOK] = isOK
 	}
 
-	stats[zkOK] = isOK
+	// mntr doesn't report the zxid, so fetch it from srvr if the zxid collector wants it. It isn't essential, so don't
+	// fail the whole poll over it
+	if _, ok := stats[zkZxid]; !ok && zk.collectors[collectorZxid] {
+		srvr, err := zk.getSrvr(ctx)
+		if err != nil {
+			log.Warnf("[%v] failed to get zxid: %v", zk.ipPort, err)
+			return stats, nil
+		}
+		for _, key := range []string{zkZxid, zkEpoch, zkLastZxidCounter} {
+			if value, ok := srvr[key]; ok {
+				stats[key] = value
+			}
+		}
+	}
 	return stats, nil
 }
 
-func (zk *zkServer) getMNTR() (map[string]string, error) {
+func (zk *zkServer) getMNTR(ctx context.Context) (map[string]string, error) {
 	stats := make(map[string]string)
 
-	byts, err := zk.sendCommand(monitorCMD)
+	byts, err := zk.sendWhitelistedCommand(ctx, monitorCMD)
 	if err != nil {
 		return stats, err
 	}
@@ -53,7 +161,7 @@ func (zk *zkServer) getMNTR() (map[string]string, error) {
 	scanner := bufio.NewScanner(bytes.NewReader(byts))
 	for scanner.Scan() {
 		splits := strings.Split(scanner.Text(), "\t")
-		if splits[0] == "This ZooKeeper instance is not currently serving requests" {
+		if splits[0] == notServingRequests {
 			log.Warnf("[%v] is up but not currently serving requests", zk.ipPort)
 			return stats, nil
 		}
@@ -67,14 +175,30 @@ func (zk *zkServer) getMNTR() (map[string]string, error) {
 	return stats, nil
 }
 
-func (zk *zkServer) getOKStatus() (string, error) {
-	byts, err := zk.sendCommand(okCMD)
+func (zk *zkServer) getOKStatus(ctx context.Context) (string, error) {
+	byts, err := zk.sendWhitelistedCommand(ctx, okCMD)
 	return string(byts), err
 }
 
-func (zk *zkServer) sendCommand(cmd string) ([]byte, error) {
-	dialer := net.Dialer{Timeout: time.Duration(*zkTimeout) * time.Second}
-	conn, err := dialer.Dial("tcp", zk.ipPort)
+// sendWhitelistedCommand is sendCommand, but returns errNotWhitelisted if the server refused to run cmd
+func (zk *zkServer) sendWhitelistedCommand(ctx context.Context, cmd string) ([]byte, error) {
+	byts, err := zk.sendCommand(ctx, cmd)
+	if err != nil {
+		return byts, err
+	}
+	// e.g. "mntr is not executed because it is not in the whitelist."
+	if bytes.Contains(byts, []byte("is not executed because it is not in the whitelist")) {
+		return byts, errNotWhitelisted
+	}
+	return byts, nil
+}
+
+func (zk *zkServer) sendCommand(ctx context.Context, cmd string) ([]byte, error) {
+	if zk.transport != nil {
+		return zk.transport.sendCommand(ctx, cmd)
+	}
+
+	conn, err := zk.dial(ctx)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -84,13 +208,16 @@ func (zk *zkServer) sendCommand(cmd string) ([]byte, error) {
 		}
 	}()
 
-	// ensure these socket fail fast if ZK having problems
-	RWDeadLine := time.Duration(*zkRWDeadLine) * time.Second
+	// ensure these socket fail fast if ZK having problems, and never outlive ctx
+	deadline := time.Now().Add(zk.rwDeadline)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
 
-	if err := conn.SetReadDeadline(time.Now().Add(RWDeadLine)); err != nil {
+	if err := conn.SetReadDeadline(deadline); err != nil {
 		log.Errorf("[%v] failed to set Read Deadline on conn: %v", zk.ipPort, err)
 	}
-	if err := conn.SetWriteDeadline(time.Now().Add(RWDeadLine)); err != nil {
+	if err := conn.SetWriteDeadline(deadline); err != nil {
 		log.Errorf("[%v] failed to set Write Deadline on conn: %v", zk.ipPort, err)
 	}
 
@@ -106,3 +233,29 @@ func (zk *zkServer) sendCommand(cmd string) ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+// metricLabels returns the label values identifying the server in its metrics: zk_instance, then targetLabelNames
+func (zk *zkServer) metricLabels() []string {
+	return append([]string{zk.ipPort}, zk.labels...)
+}
+
+// dial opens a connection to the client port, or the secureClientPort over TLS if we have a TLS config
+func (zk *zkServer) dial(ctx context.Context) (net.Conn, error) {
+	addr := zk.ipPort
+	if zk.addr != "" {
+		addr = zk.addr
+	}
+
+	netDialer := &net.Dialer{Timeout: zk.connectTimeout}
+	if zk.tlsConfig == nil {
+		return netDialer.DialContext(ctx, "tcp", addr)
+	}
+
+	dialer := &tls.Dialer{NetDialer: netDialer, Config: zk.tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	zk.recordPeerCertificate(conn.(*tls.Conn).ConnectionState())
+	return conn, nil
+}
@@ -1,18 +1,216 @@
 package main
 
-//func TestZKServer(t *testing.T) {
-//	t.Run("getStats() on localhost", func(t *testing.T) {
-//		zks := newZKServer("127.0.0.1:2181")
-//
-//		_, err := zks.getStats()
-//		if err == nil {
-//			t.Error("getStats on localhost did not return an error")
-//		}
-//	})
-//}
-//
-//func TestPoller(t *testing.T) {
-//	t.Run("poller 1.0", func(t *testing.T) {
-//		// Mock a zookeeper server here
-//	})
-//}
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	"gotest.tools/poll"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFakeZK starts a fake leader, and a zkServer polling it. Its settings are set here rather than taken from the
+// flags, so tests don't depend on what other tests left in them
+func startFakeZK(t *testing.T) (*fakeZK, *zkServer) {
+	f, err := newFakeZK("127.0.0.1:0")
+	assert.NilError(t, err)
+	zk := newZKServer(f.addr())
+	zk.targetSettings = targetSettings{
+		pollInterval:   time.Second,
+		connectTimeout: time.Second,
+		rwDeadline:     time.Second,
+		collectors:     collectorSet{},
+	}
+	zk.tlsConfig, zk.httpClient = nil, newHTTPClient(nil)
+	return f, zk
+}
+
+func TestZKServer(t *testing.T) {
+	t.Run("getStats() from a leader", func(t *testing.T) {
+		f, zk := startFakeZK(t)
+		defer f.close()
+		zk.collectors = collectorSet{collectorZxid: true}
+
+		stats, err := zk.getStats(context.Background())
+		assert.NilError(t, err)
+		assert.Equal(t, stats[zkServerState], "leader")
+		assert.Equal(t, stats[zkOK], "imok")
+		assert.Equal(t, stats[zkFollowers], "2")
+		// mntr doesn't report it, srvr does
+		assert.Equal(t, stats[zkZxid], "4294967296")
+		assert.Equal(t, stats[zkEpoch], "1")
+	})
+
+	t.Run("getStats() only sends srvr for the zxid collector", func(t *testing.T) {
+		f, zk := startFakeZK(t)
+		defer f.close()
+
+		stats, err := zk.getStats(context.Background())
+		assert.NilError(t, err)
+		assert.Equal(t, stats[zkServerState], "leader")
+		_, ok := stats[zkZxid]
+		assert.Assert(t, !ok)
+		assert.Equal(t, f.requestCount(srvrCMD), 0)
+	})
+
+	t.Run("getStats() falls back to srvr when mntr isn't whitelisted", func(t *testing.T) {
+		f, zk := startFakeZK(t)
+		defer f.close()
+		f.setMode("follower")
+		f.setResponse(monitorCMD, "mntr is not executed because it is not in the whitelist.\n")
+
+		stats, err := zk.getStats(context.Background())
+		assert.NilError(t, err)
+		assert.Equal(t, stats[zkServerState], "follower")
+		assert.Equal(t, stats[zkZnodeCount], "5")
+		assert.Equal(t, f.requestCount(srvrCMD), 1)
+	})
+
+	t.Run("getStats() leaves zk_ok out when ruok isn't whitelisted", func(t *testing.T) {
+		f, zk := startFakeZK(t)
+		defer f.close()
+		f.setResponse(okCMD, "ruok is not executed because it is not in the whitelist.\n")
+
+		stats, err := zk.getStats(context.Background())
+		assert.NilError(t, err)
+		assert.Equal(t, stats[zkServerState], "leader")
+		_, ok := stats[zkOK]
+		assert.Assert(t, !ok)
+	})
+
+	t.Run("getStats() from a server not serving requests", func(t *testing.T) {
+		f, zk := startFakeZK(t)
+		defer f.close()
+		f.setServing(false)
+
+		stats, err := zk.getStats(context.Background())
+		assert.NilError(t, err)
+		_, ok := stats[zkServerState]
+		assert.Assert(t, !ok, "no state should be reported")
+		assert.Equal(t, stats[zkOK], "imok")
+	})
+
+	t.Run("getStats() from a slow server", func(t *testing.T) {
+		f, zk := startFakeZK(t)
+		defer f.close()
+		f.setDelay(time.Second)
+		zk.rwDeadline = 50 * time.Millisecond
+
+		_, err := zk.getStats(context.Background())
+		assert.ErrorContains(t, err, "timeout")
+	})
+
+	t.Run("getStats() from a server resetting connections", func(t *testing.T) {
+		f, zk := startFakeZK(t)
+		defer f.close()
+		f.setReset(true)
+
+		_, err := zk.getStats(context.Background())
+		assert.ErrorContains(t, err, "reset")
+	})
+
+	t.Run("getStats() with nothing listening", func(t *testing.T) {
+		f, zk := startFakeZK(t)
+		assert.NilError(t, f.close())
+
+		_, err := zk.getStats(context.Background())
+		assert.ErrorContains(t, err, "refused")
+	})
+}
+
+func TestPoller(t *testing.T) {
+	f, zk := startFakeZK(t)
+	defer f.close()
+	zk.pollInterval = 10 * time.Millisecond
+	zk.collectors = collectorSet{}
+
+	metrics := newMetrics()
+	p := startRunner(newPoller(zk.pollInterval, metrics, zk).pollForMetrics)
+	defer p.stop()
+
+	// waits until the metrics collected are want
+	waitFor := func(want string, names ...string) {
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			if err := testutil.CollectAndCompare(metrics, strings.NewReader(want), names...); err != nil {
+				return poll.Continue("%v", err)
+			}
+			return poll.Success()
+		})
+	}
+	instance := `{zk_instance="` + zk.ipPort + `"}`
+
+	waitFor(`
+# HELP up Whether the zk instance answered the last poll
+# TYPE up gauge
+up`+instance+` 1
+# HELP zk_server_state Current state of the zk instance: 1 = follower, 2 = leader, 3 = standalone, -1 if unknown
+# TYPE zk_server_state gauge
+zk_server_state`+instance+` 2
+`, "up", "zk_server_state")
+
+	f.setMode("follower")
+	waitFor(`
+# HELP zk_server_state Current state of the zk instance: 1 = follower, 2 = leader, 3 = standalone, -1 if unknown
+# TYPE zk_server_state gauge
+zk_server_state`+instance+` 1
+`, "zk_server_state")
+
+	f.setReset(true)
+	waitFor(`
+# HELP up Whether the zk instance answered the last poll
+# TYPE up gauge
+up`+instance+` 0
+`, "up")
+	assert.Assert(t, testutil.ToFloat64(metrics.pollingFailureCounter.WithLabelValues(zk.ipPort)) >= 1)
+}
+
+func TestPollerRefreshMetrics(t *testing.T) {
+	f, zk := startFakeZK(t)
+	defer f.close()
+
+	metrics := newMetrics()
+	p := newPoller(time.Second, metrics, zk)
+	stats, err := zk.getStats(context.Background())
+	p.refreshMetrics(stats, err)
+
+	instance := `{zk_instance="` + zk.ipPort + `"}`
+	want := `
+# HELP zk_followers Leader only: number of followers.
+# TYPE zk_followers gauge
+zk_followers` + instance + ` 2
+# HELP zk_synced_followers Leader only: number of followers currently in sync
+# TYPE zk_synced_followers gauge
+zk_synced_followers` + instance + ` 2
+# HELP zk_znode_count Znode count
+# TYPE zk_znode_count gauge
+zk_znode_count` + instance + ` 5
+`
+	assert.NilError(t, testutil.CollectAndCompare(metrics, strings.NewReader(want),
+		"zk_followers", "zk_synced_followers", "zk_znode_count"))
+}
+
+func TestFakeZK(t *testing.T) {
+	f, zk := startFakeZK(t)
+	defer f.close()
+
+	for cmd, want := range map[string]string{
+		okCMD:   "imok",
+		isroCMD: "rw",
+		enviCMD: "Environment:\nzookeeper.version=" + fakeZKVersion,
+		"xxxx":  "",
+	} {
+		byts, err := zk.sendCommand(context.Background(), cmd)
+		assert.NilError(t, err)
+		assert.Assert(t, strings.HasPrefix(string(byts), want), "%v: got %q", cmd, byts)
+	}
+
+	conns, err := zk.getCons(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, len(conns), 1)
+
+	f.setReadOnly(true)
+	byts, err := zk.sendCommand(context.Background(), isroCMD)
+	assert.NilError(t, err)
+	assert.Equal(t, string(byts), "ro")
+}